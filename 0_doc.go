@@ -14,6 +14,7 @@
 // General usage:
 //
 // First, you will need to create a new powerwall.Client object using the
-// NewClient function.  After that has been done, you can use any of the
+// NewClient function (or NewClientWithOptions, if you need to customize how
+// the client connects to the gateway).  After that has been done, you can use any of the
 // following functions on that object to interact with the Powerwall gateway.
 package powerwall
@@ -3,25 +3,59 @@
 // (Note: DoLogin generally does not need to be called explicitly)
 //
 //   (*Client) DoLogin()
+//   (*Client) DoLoginContext(ctx)
 //   (*Client) GetAuthToken()
 //   (*Client) SetAuthToken(token string)
+//   (*Client) Roles()
 //
 package powerwall
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Roles which can be granted by the gateway at login (see (*Client).Roles):
+const (
+	RoleHomeOwner        = "Home_Owner"        // A "customer" login
+	RoleProviderEngineer = "Provider_Engineer" // An "installer" login
+	RoleTeslaEngineer    = "Tesla_Engineer"
+)
+
+// Usernames used for the different types of login:
+const (
+	loginUsernameCustomer  = "customer"
+	loginUsernameInstaller = "installer"
+)
+
+// installerRoles are the roles which are allowed to use installer-only APIs.
+var installerRoles = []string{RoleProviderEngineer, RoleTeslaEngineer}
+
+// requiredRoles lists the APIs which can only be used with certain roles.
+// Calls to these APIs will fail with InsufficientRole (without contacting the
+// gateway) if the client's login is known not to have one of these roles.
+var requiredRoles = map[string][]string{
+	"v2/islanding/mode": installerRoles,
+}
+
 const (
 	cmd_DO_LOGIN int = iota
 	cmd_CHECK_LOGIN
+	cmd_RELOGIN
 	cmd_SET_TOKEN
 )
 
 type authMessage struct {
+	ctx       context.Context
 	action    int
-	email     string
-	password  string
 	token     string
 	result_ch chan error
 }
@@ -32,49 +66,96 @@ type authMessage struct {
 // anyway if a call is made which requires authentication and it is not already
 // successfully logged in.
 func (c *Client) DoLogin() error {
-	action := authMessage{
-		action:    cmd_DO_LOGIN,
-		email:     c.gatewayLoginEmail,
-		password:  c.gatewayLoginPassword,
-		result_ch: make(chan error),
-	}
-	c.auth_ch <- &action
-	return <-action.result_ch
+	return c.DoLoginContext(context.Background())
+}
+
+// DoLoginContext is the same as DoLogin, but uses the provided context to
+// allow cancelling or setting a deadline on the login attempt.
+func (c *Client) DoLoginContext(ctx context.Context) error {
+	return c.sendAuthMsg(ctx, cmd_DO_LOGIN, "")
+}
+
+func (c *Client) checkLogin(ctx context.Context) error {
+	return c.sendAuthMsg(ctx, cmd_CHECK_LOGIN, "")
+}
+
+// reLogin is called when a request made using staleToken was rejected by the
+// gateway.  It logs in again, unless the token has already been replaced
+// (because some other request got there first), in which case it just returns
+// so the caller can retry with the new token.  Since the auth manager handles
+// messages one at a time, this means that if many requests fail at once, only
+// one login will actually be performed.
+func (c *Client) reLogin(ctx context.Context, staleToken string) error {
+	return c.sendAuthMsg(ctx, cmd_RELOGIN, staleToken)
 }
 
-func (c *Client) checkLogin() error {
+func (c *Client) sendAuthMsg(ctx context.Context, cmd int, token string) error {
 	action := authMessage{
-		action:    cmd_CHECK_LOGIN,
-		email:     c.gatewayLoginEmail,
-		password:  c.gatewayLoginPassword,
-		result_ch: make(chan error),
+		ctx:    ctx,
+		action: cmd,
+		token:  token,
+		// This is buffered so that the manager will not get stuck
+		// trying to send the result if we have already given up
+		// waiting for it.
+		result_ch: make(chan error, 1),
+	}
+	select {
+	case c.auth_ch <- &action:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClientClosed
+	}
+	select {
+	case err := <-action.result_ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClientClosed
 	}
-	c.auth_ch <- &action
-	return <-action.result_ch
 }
 
 // GetAuthToken returns the current auth token in use.  This can be saved and
 // then passed to SetAuthToken on later connections to re-use the same token
 // across Clients.
+//
+// If the client has been closed, this returns an empty string.
 func (c *Client) GetAuthToken() string {
-	return <-c.token_ch
+	token, _ := c.getAuthToken(context.Background())
+	return token
+}
+
+func (c *Client) getAuthToken(ctx context.Context) (string, error) {
+	select {
+	case token := <-c.token_ch:
+		return token, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.closed:
+		return "", ErrClientClosed
+	}
 }
 
 // SetAuthToken sets the provided string as the new auth token to use for
-// subsequent API calls.
+// subsequent API calls.  (If the client has been closed, this does nothing.)
 func (c *Client) SetAuthToken(token string) {
-	c.auth_ch <- &authMessage{action: cmd_SET_TOKEN, token: token}
+	select {
+	case c.auth_ch <- &authMessage{action: cmd_SET_TOKEN, token: token}:
+	case <-c.closed:
+		return
+	}
 	// Wait until we are sure the manager is returning the updated token before returning.
 	for {
-		t := <-c.token_ch
-		if t == token {
+		t, err := c.getAuthToken(context.Background())
+		if err != nil || t == token {
 			break
 		}
 	}
 }
 
 func (c *Client) authManager() {
-	var authToken = ""
+	var authToken = c.loadStoredToken()
 
 	for {
 		// We do a double-select here because we want to ensure that
@@ -93,6 +174,9 @@ func (c *Client) authManager() {
 			c.doAuthMsg(msg, &authToken)
 			continue
 		case c.token_ch <- authToken:
+		case <-c.closed:
+			c.logf("Client closed.  Auth manager exiting.")
+			return
 		}
 	}
 }
@@ -103,17 +187,25 @@ func (c *Client) doAuthMsg(msg *authMessage, authToken *string) {
 	switch msg.action {
 	case cmd_SET_TOKEN:
 		*authToken = msg.token
+		c.setRoles(nil)
 		c.logf("Set auth token")
 	case cmd_DO_LOGIN:
-		*authToken, err = c.performLogin(msg.email, msg.password)
+		*authToken, err = c.login(msg.ctx, *authToken)
 		msg.result_ch <- err
 	case cmd_CHECK_LOGIN:
 		if *authToken == "" {
-			*authToken, err = c.performLogin(msg.email, msg.password)
+			*authToken, err = c.login(msg.ctx, *authToken)
 		} else {
 			err = nil
 		}
 		msg.result_ch <- err
+	case cmd_RELOGIN:
+		if *authToken == msg.token {
+			*authToken, err = c.login(msg.ctx, *authToken)
+		} else {
+			c.logf("Auth token already refreshed.  Skipping re-login.")
+		}
+		msg.result_ch <- err
 	}
 }
 
@@ -131,19 +223,42 @@ type loginResponse struct {
 	Roles     []string `json:"roles"`
 	Token     string   `json:"token"`
 	Provider  string   `json:"provider"`
-	loginTime string   `json:"loginTime"`
+	LoginTime string   `json:"loginTime"`
 }
 
-func (c *Client) performLogin(email, password string) (string, error) {
-	c.logf("Attempting login...")
+func (c *Client) performLogin(ctx context.Context) (string, error) {
+	if until := c.loginThrottle.Until; time.Now().Before(until) {
+		// The gateway told us not to try again yet, and trying anyway
+		// will probably just extend the lockout.
+		throttled := c.loginThrottle
+		throttled.RetryAfter = time.Until(until)
+		c.logf("Login suppressed: gateway is throttling logins for another %s", throttled.RetryAfter.Round(time.Second))
+		return "", throttled
+	}
+
+	// We ask for the credentials each time we log in (rather than once
+	// when the client is created), so that they can be changed without
+	// having to create a new client.
+	creds, err := c.resolveCredentials(ctx)
+	if err != nil {
+		c.logf("Unable to obtain login credentials: %s", err)
+		return "", fmt.Errorf("unable to obtain login credentials: %w", err)
+	}
+	email, password, err := creds.Credentials(ctx)
+	if err != nil {
+		c.logf("Unable to obtain login credentials: %s", err)
+		return "", fmt.Errorf("unable to obtain login credentials: %w", err)
+	}
+
+	c.logf("Attempting login: username=%s email=%s force_sm_off=%v", c.gatewayLoginUsername, email, c.forceSmOff)
 	ld := loginData{
-		Username:   "customer",
+		Username:   c.gatewayLoginUsername,
 		Email:      email,
 		Password:   password,
-		ForceSmOff: false,
+		ForceSmOff: c.forceSmOff,
 	}
 	resp := loginResponse{}
-	err := c.apiPostJson("login/Basic", ld, &resp)
+	err = c.apiPostJson(ctx, "login/Basic", ld, &resp)
 
 	// Check for presence of a Token first, because if there was some issue
 	// unmarshalling the full response, it will return an error, but it may
@@ -151,10 +266,12 @@ func (c *Client) performLogin(email, password string) (string, error) {
 	// which is really all we need.
 	if resp.Token != "" {
 		// We got back a token.  We're good!
-		c.logf("Login successful")
+		c.logf("Login successful: roles=%v", resp.Roles)
+		c.setRoles(resp.Roles)
 		return resp.Token, nil
 	} else if err != nil {
 		c.logf("Login failed: %s", err)
+		errors.As(err, &c.loginThrottle)
 		return "", err
 	} else {
 		// No error, but also no token?
@@ -162,3 +279,140 @@ func (c *Client) performLogin(email, password string) (string, error) {
 		return "", errors.New("No auth token returned from login API call")
 	}
 }
+
+// resolveCredentials returns the CredentialProvider to use for logging in.
+// This is normally just the one the client was configured with, but a
+// SerialCredentials with no Serial is filled in with the gateway's DIN (which
+// is fetched from the gateway the first time it is needed, and remembered
+// after that).  (This must only be called from the auth manager.)
+func (c *Client) resolveCredentials(ctx context.Context) (CredentialProvider, error) {
+	sc, ok := c.credentials.(*SerialCredentials)
+	if !ok || sc.Serial != "" {
+		return c.credentials, nil
+	}
+	if c.loginDin == "" {
+		// The "status" API does not need a login (and does not go
+		// through the auth manager), so it is safe to call it here.
+		status := StatusData{}
+		err := c.apiGetJson(ctx, "status", &status)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get gateway serial number: %w", err)
+		}
+		c.loginDin = status.Din
+	}
+	return NewSerialCredentials(sc.Email, c.loginDin), nil
+}
+
+// Roles returns the roles which the gateway granted to the client the last
+// time it logged in (see the Role* constants).  This will generally be
+// RoleHomeOwner for a customer login, or RoleProviderEngineer for an installer
+// login (see WithInstallerLogin).
+//
+// If the client has not logged in yet, or is using a token which it did not
+// obtain itself (one supplied with SetAuthToken, or loaded from a TokenStore),
+// the roles are not known, and this returns nil.
+func (c *Client) Roles() []string {
+	c.rolesMutex.Lock()
+	defer c.rolesMutex.Unlock()
+	if c.roles == nil {
+		return nil
+	}
+	return append([]string{}, c.roles...)
+}
+
+func (c *Client) setRoles(roles []string) {
+	c.rolesMutex.Lock()
+	defer c.rolesMutex.Unlock()
+	c.roles = roles
+}
+
+// checkRole returns an InsufficientRole error if the specified API requires a
+// role which the client is known not to have.  If the client's roles are not
+// known, it returns nil (and it is up to the gateway to decide).
+func (c *Client) checkRole(api string) error {
+	required, ok := requiredRoles[api]
+	if !ok {
+		return nil
+	}
+	roles := c.Roles()
+	if roles == nil {
+		return nil
+	}
+	for _, role := range roles {
+		for _, r := range required {
+			if role == r {
+				return nil
+			}
+		}
+	}
+	return InsufficientRole{API: api, Required: required, Roles: roles}
+}
+
+// defaultLoginThrottle is how long we assume a login lockout lasts, if the
+// gateway doesn't tell us.
+const defaultLoginThrottle = 5 * time.Minute
+
+var lockoutPeriodRegexp = regexp.MustCompile(`(?i)(\d+)\s*(second|sec|minute|min)`)
+
+// checkLoginThrottled checks whether an (unsuccessful) response to a login
+// request means that the gateway is throttling logins.  This is indicated
+// either by a 429 status code, or (for some firmware versions) a 401 with an
+// error message saying the account has been locked.
+func checkLoginThrottled(url url.URL, resp *http.Response, body []byte) (LoginThrottled, bool) {
+	errInfo := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	_ = json.Unmarshal(body, &errInfo)
+	text := strings.ToLower(errInfo.Error + " " + errInfo.Message)
+	if resp.StatusCode != http.StatusTooManyRequests && !strings.Contains(text, "locked") && !strings.Contains(text, "too many") {
+		return LoginThrottled{}, false
+	}
+
+	msg := errInfo.Message
+	if msg == "" {
+		msg = errInfo.Error
+	}
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if retryAfter <= 0 {
+		// See if the message says how long it will be.
+		if m := lockoutPeriodRegexp.FindStringSubmatch(msg); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			retryAfter = time.Duration(n) * time.Second
+			if strings.HasPrefix(strings.ToLower(m[2]), "min") {
+				retryAfter *= 60
+			}
+		}
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultLoginThrottle
+	}
+
+	return LoginThrottled{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Message:    msg,
+		RetryAfter: retryAfter,
+		Until:      time.Now().Add(retryAfter),
+	}, true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can be
+// either a number of seconds or an HTTP date.  It returns zero if the value is
+// missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
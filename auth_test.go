@@ -0,0 +1,165 @@
+package powerwall_test
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+// countRequests returns how many of the recorded requests were for the
+// specified API.
+func countRequests(s *powerwalltest.Server, api string) int {
+	count := 0
+	for _, r := range s.Requests() {
+		if r.API == api {
+			count++
+		}
+	}
+	return count
+}
+
+func TestConcurrentRelogin(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+	if err := client.DoLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure all of the requests are in progress at the same time when
+	// they find out the token has expired.
+	const n = 10
+	s.ExpireTokens()
+	s.ResetRequests()
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 100 * time.Millisecond, Count: n})
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.GetSOE()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("call %d failed: %v", i, err)
+		}
+	}
+	if logins := countRequests(s, "login/Basic"); logins != 1 {
+		t.Errorf("expected exactly 1 login, got %d", logins)
+	}
+	if calls := countRequests(s, "system_status/soe"); calls != 2*n {
+		t.Errorf("expected each call to be retried once (%d requests), got %d", 2*n, calls)
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	s.SetLoginLockout(3, time.Minute)
+	client := s.NewClient(powerwall.WithLogger(t.Log), powerwall.WithLogin(powerwalltest.DefaultEmail, "wrong"))
+	defer client.Close()
+
+	_, err := client.GetSOE()
+	var authErr powerwall.AuthFailure
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected AuthFailure, got %v", err)
+	}
+
+	// After a few more failures, the gateway locks us out.
+	var throttled powerwall.LoginThrottled
+	for i := 0; i < 3 && !errors.As(err, &throttled); i++ {
+		_, err = client.GetSOE()
+	}
+	if !errors.As(err, &throttled) {
+		t.Fatalf("expected LoginThrottled, got %v", err)
+	}
+	if logins := countRequests(s, "login/Basic"); logins != 4 {
+		t.Errorf("expected 3 failed logins and then a throttled one, got %d logins", logins)
+	}
+	if throttled.StatusCode != http.StatusTooManyRequests || throttled.RetryAfter != time.Minute {
+		t.Errorf("unexpected LoginThrottled contents: %+v", throttled)
+	}
+	if until := time.Until(throttled.Until); until <= 0 || until > time.Minute {
+		t.Errorf("unexpected Until (%s from now)", until)
+	}
+
+	// Until the lockout expires, the client should not even try to log
+	// in (which would just extend the lockout on some firmware).
+	s.ResetRequests()
+	_, err = client.GetSOE()
+	if !errors.As(err, &throttled) {
+		t.Errorf("expected LoginThrottled while locked out, got %v", err)
+	} else if throttled.RetryAfter > time.Minute || throttled.RetryAfter <= 0 {
+		t.Errorf("RetryAfter not updated for the remaining time: %s", throttled.RetryAfter)
+	}
+	if logins := countRequests(s, "login/Basic"); logins != 0 {
+		t.Errorf("client tried to log in %d times while locked out", logins)
+	}
+}
+
+func TestInsufficientRole(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	// Before logging in, we don't know our roles, so it's up to the
+	// gateway to refuse.
+	if roles := client.Roles(); roles != nil {
+		t.Errorf("roles known before login: %v", roles)
+	}
+	err := client.GoOffGrid()
+	var roleErr powerwall.InsufficientRole
+	if !errors.As(err, &roleErr) {
+		t.Fatalf("expected InsufficientRole, got %v", err)
+	}
+	if roleErr.API != "v2/islanding/mode" || len(roleErr.Roles) != 1 || roleErr.Roles[0] != powerwall.RoleHomeOwner {
+		t.Errorf("unexpected InsufficientRole contents: %+v", roleErr)
+	}
+
+	// Now that we know, we shouldn't even ask.
+	s.ResetRequests()
+	if err := client.GoOnGrid(); !errors.As(err, &roleErr) {
+		t.Errorf("expected InsufficientRole, got %v", err)
+	}
+	if reqs := s.Requests(); len(reqs) != 0 {
+		t.Errorf("requests were made for a call which was known to fail: %+v", reqs)
+	}
+
+	// Other APIs are unaffected.
+	if _, err := client.GetSOE(); err != nil {
+		t.Errorf("customer API failed: %v", err)
+	}
+}
+
+func TestInstallerLogin(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(
+		powerwall.WithLogger(t.Log),
+		powerwall.WithInstallerLogin(powerwalltest.DefaultEmail, powerwalltest.DefaultPassword, false),
+	)
+	defer client.Close()
+
+	if err := client.GoOffGrid(); err != nil {
+		t.Fatalf("GoOffGrid failed with an installer login: %v", err)
+	}
+	roles := client.Roles()
+	if len(roles) != 1 || roles[0] != powerwall.RoleProviderEngineer {
+		t.Errorf("unexpected roles %v", roles)
+	}
+	if n := countRequests(s, "v2/islanding/mode"); n != 1 {
+		t.Errorf("expected 1 islanding request, got %d", n)
+	}
+}
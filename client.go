@@ -1,12 +1,16 @@
 // Functions for configuring the client object:
 //
 //   (*Client) FetchTLSCert()
+//   (*Client) FetchTLSCertContext(ctx)
 //   (*Client) SetTLSCert(cert)
+//   (*Client) TrySetTLSCert(cert)
+//   (*Client) Close()
 //
 package powerwall
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -15,7 +19,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,13 +51,29 @@ func SetErrFunc(f func(string, error)) {
 // Client represents a connection to a Tesla Energy Gateway (Powerwall controller).
 type Client struct {
 	gatewayAddress       string
-	gatewayLoginEmail    string
-	gatewayLoginPassword string
+	gatewayPort          int
+	credentials          CredentialProvider
+	gatewayLoginUsername string
+	forceSmOff           bool
 	httpClient           http.Client
+	userAgent            string
+	logFunc              func(...interface{})
 	token_ch             chan string
 	auth_ch              chan *authMessage
+	closed               chan struct{}
+	closeOnce            sync.Once
 	retryInterval        time.Duration
 	retryTimeout         time.Duration
+	sitemasterTimeout    time.Duration
+	tokenStore           TokenStore
+	loginThrottle        LoginThrottled // Only accessed by authManager
+	loginDin             string         // Only accessed by authManager
+	rolesMutex           sync.Mutex
+	roles                []string
+	decodePolicy         DecodePolicy
+	schemaCheck          bool
+	schemaFunc           func(SchemaDrift)
+	schema               schemaState
 }
 
 // NewClient creates a new Client object.  gatewayAddress should be the IP
@@ -64,39 +87,99 @@ type Client struct {
 // For more information on logging into an Energy Gateway, see
 // https://www.tesla.com/support/energy/powerwall/own/monitoring-from-home-network
 func NewClient(gatewayAddress string, gatewayLoginEmail string, gatewayLoginPassword string) *Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			// The TEG apparently requires a valid SNI hostname
-			// matching its cert, or it will just bomb out and
-			// terminate the connection during TLS negotiation
-			// (even if we're not checking the cert), so we
-			// override the TLS ServerName here to use one of its
-			// (hardcoded) stock names for all connections.
-			ServerName: "powerwall",
-		},
+	return NewClientWithOptions(gatewayAddress, WithLogin(gatewayLoginEmail, gatewayLoginPassword))
+}
+
+// NewClientWithOptions creates a new Client object, the same as NewClient,
+// but allows customizing how the client connects to the gateway by supplying
+// any number of Option values (see the With* functions).  Login credentials
+// can be supplied using the WithLogin option.
+func NewClientWithOptions(gatewayAddress string, options ...Option) *Client {
+	opts := defaultClientOptions()
+	for _, option := range options {
+		option(&opts)
 	}
-	httpClient := http.Client{
-		Transport: tr,
-		Timeout:   time.Second * 2, // Timeout after 2 seconds
+	if opts.credentials == nil {
+		opts.credentials = StaticCredentials{}
 	}
 
 	c := &Client{
 		gatewayAddress:       gatewayAddress,
-		gatewayLoginEmail:    gatewayLoginEmail,
-		gatewayLoginPassword: gatewayLoginPassword,
-		httpClient:           httpClient,
+		gatewayPort:          opts.port,
+		credentials:          opts.credentials,
+		gatewayLoginUsername: opts.username,
+		forceSmOff:           opts.forceSmOff,
+		httpClient:           opts.httpClient(),
+		userAgent:            opts.userAgent,
+		logFunc:              opts.logFunc,
 		token_ch:             make(chan string),
 		auth_ch:              make(chan *authMessage),
+		closed:               make(chan struct{}),
+		sitemasterTimeout:    opts.smTimeout,
+		tokenStore:           opts.tokenStore,
+		decodePolicy:         opts.decodePolicy,
+		schemaCheck:          opts.schemaCheck,
+		schemaFunc:           opts.schemaFunc,
+		schema:               schemaState{reported: map[SchemaDrift]bool{}},
 	}
 
 	go c.authManager()
 
-	c.logf("New powerwall client created: gateway_address=%s email=%s", gatewayAddress, gatewayLoginEmail)
+	c.logf("New powerwall client created: gateway_address=%s credentials=%T", c.gatewayHost(), opts.credentials)
 	return c
 }
 
+// gatewayHost returns the host (and port, if not the default) to use when
+// connecting to the gateway.
+func (c *Client) gatewayHost() string {
+	if c.gatewayPort == 0 || c.gatewayPort == 443 {
+		return c.gatewayAddress
+	}
+	return net.JoinHostPort(c.gatewayAddress, strconv.Itoa(c.gatewayPort))
+}
+
+// Close shuts down the client, stopping its background processing and
+// cancelling any requests which are currently in progress.  Any calls which
+// are waiting on the client (or made after it has been closed) will return
+// ErrClientClosed.
+//
+// It is safe to call Close more than once.  It always returns nil.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.logf("Client closed")
+	})
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// withCloseCancel returns a copy of ctx which will also be cancelled if the
+// client is closed.
+func (c *Client) withCloseCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func (c *Client) logf(format string, v ...interface{}) {
+	logFunc := logFunc
+	if c.logFunc != nil {
+		logFunc = c.logFunc
+	}
 	logFunc(fmt.Sprintf("{%p} ", c) + fmt.Sprintf(format, v...))
 }
 
@@ -110,28 +193,65 @@ func (c *Client) jsonError(api string, data []byte, err error) {
 // obtain the current certificate in use by the gateway initially via
 // `FetchTLSCert`, and then supply it via this function whenever creating a new
 // connection to ensure the certificate matches the previously fetched one.
+//
+// Note that this only works if the client is using an *http.Transport (which
+// is the default).  If a different http.RoundTripper has been supplied via the
+// WithTransport option, the certificate is not used (and an error is
+// reported via the error function set with SetErrFunc).  Use TrySetTLSCert
+// instead if you need to know whether it worked.
 func (c *Client) SetTLSCert(cert *x509.Certificate) {
+	if err := c.TrySetTLSCert(cert); err != nil {
+		errFunc("Unable to set TLS cert", err)
+	}
+}
+
+// TrySetTLSCert is the same as SetTLSCert, but returns ErrUnsupportedTransport
+// if the client is not using an *http.Transport (in which case configuring TLS
+// is the responsibility of the RoundTripper supplied with WithTransport).
+func (c *Client) TrySetTLSCert(cert *x509.Certificate) error {
+	tr, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		c.logf("Cannot set TLS cert: unsupported transport type %T", c.httpClient.Transport)
+		return ErrUnsupportedTransport
+	}
+
 	certPool := x509.NewCertPool()
 	certPool.AddCert(cert)
 
-	c.httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = false
-	c.httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = certPool
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.InsecureSkipVerify = false
+	tr.TLSClientConfig.RootCAs = certPool
 	c.logf("Set TLS cert for validation: %s", cert.Subject)
+	return nil
 }
 
 // FetchTLSCert queries the gateway and returns a copy of the TLS certificate
 // it is currently presenting for connections.  This is useful for saving and
 // later using with `SetTLSCert` to validate future connections.
 func (c *Client) FetchTLSCert() (*x509.Certificate, error) {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+	return c.FetchTLSCertContext(context.Background())
+}
+
+// FetchTLSCertContext is the same as FetchTLSCert, but uses the provided
+// context to allow cancelling or setting a deadline on the connection.
+func (c *Client) FetchTLSCertContext(ctx context.Context) (*x509.Certificate, error) {
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	port := c.gatewayPort
+	if port == 0 {
+		port = 443
 	}
-	conn, err := tls.Dial("tcp", c.gatewayAddress+":443", tlsConfig)
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.gatewayAddress, strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	certs := conn.ConnectionState().PeerCertificates
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
 
 	return certs[0], nil
 }
@@ -141,6 +261,10 @@ func (c *Client) FetchTLSCert() (*x509.Certificate, error) {
 //
 // (Note: The client will only attempt retries on network errors (connection
 // timed out, etc), not other issues)
+//
+// If a request is made using one of the "Context" variants of the API
+// functions, retries will also stop as soon as the context is cancelled or its
+// deadline expires.
 func (c *Client) SetRetry(interval time.Duration, timeout time.Duration) {
 	c.retryInterval = interval
 	c.retryTimeout = timeout
@@ -159,6 +283,10 @@ func (c *Client) httpDo(req *http.Request) (*http.Response, error) {
 			// We only retry on net.Error
 			break
 		}
+		if req.Context().Err() != nil {
+			// The caller doesn't want us to keep trying.
+			break
+		}
 		if time.Now().Sub(start_time) >= c.retryTimeout {
 			// We've retried as long as we can.  Give up.
 			break
@@ -168,12 +296,58 @@ func (c *Client) httpDo(req *http.Request) (*http.Response, error) {
 		// have already used some or all of the time of the retry
 		// interval, so figure out how much (if any) is remaining to
 		// wait.
-		time.Sleep(c.retryInterval - (time.Now().Sub(attempt_time)))
+		err = sleepContext(req.Context(), c.retryInterval-(time.Now().Sub(attempt_time)))
+		if err != nil {
+			return nil, err
+		}
 	}
 	return resp, err
 }
 
-func (c *Client) doHttpRequest(api string, method string, payload []byte, contentType string) ([]byte, error) {
+// sleepContext pauses for the specified duration, or until the context is
+// cancelled, whichever comes first.  It returns the context's error if the
+// sleep was cut short.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) doHttpRequest(ctx context.Context, api string, method string, payload []byte, contentType string) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if err := c.checkRole(api); err != nil {
+		c.logf("Not calling API %s: %s", api, err)
+		return nil, err
+	}
+	ctx, cancel := c.withCloseCancel(ctx)
+	defer cancel()
+
+	body, err := c.performHttpRequest(ctx, api, method, payload, contentType)
+	if err != nil && c.isClosed() {
+		// Whatever went wrong, it was most likely because we were
+		// closed in the middle of things.
+		return nil, ErrClientClosed
+	}
+	return body, err
+}
+
+// publicAPIs lists the APIs (other than "login/...") which the gateway allows
+// to be called without logging in first.
+var publicAPIs = map[string]bool{
+	"status": true,
+}
+
+func (c *Client) performHttpRequest(ctx context.Context, api string, method string, payload []byte, contentType string) ([]byte, error) {
 	type errorResponse struct {
 		Code    int    `json:"code"`
 		Error   string `json:"error"`
@@ -186,34 +360,42 @@ func (c *Client) doHttpRequest(api string, method string, payload []byte, conten
 
 	url := url.URL{
 		Scheme: "https",
-		Host:   c.gatewayAddress,
+		Host:   c.gatewayHost(),
 		Path:   "api/" + api,
 	}
 
 	c.logf("Calling API: method=%s url=%s body=%s", method, url.String(), logBody(api, payload, contentType))
 
 	if payload == nil {
-		req, err = http.NewRequest(method, url.String(), nil)
+		req, err = http.NewRequestWithContext(ctx, method, url.String(), nil)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		req, err = http.NewRequest(method, url.String(), bytes.NewBuffer(payload))
+		req, err = http.NewRequestWithContext(ctx, method, url.String(), bytes.NewBuffer(payload))
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", contentType)
 	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
 
-	if strings.HasPrefix(api, "login/") {
-		// If we're doing a login API call, don't set the auth cookie,
-		// or attempt to retry on auth issues.
+	if strings.HasPrefix(api, "login/") || publicAPIs[api] {
+		// If we're doing a login API call (or one which doesn't need
+		// login), don't set the auth cookie, or attempt to retry on auth
+		// issues.  (This also means we don't need to ask the auth
+		// manager for the token, so these can be called during login.)
 		resp, err = c.httpDo(req)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		authToken := c.GetAuthToken()
+		authToken, err := c.getAuthToken(ctx)
+		if err != nil {
+			return nil, err
+		}
 		if authToken != "" {
 			cookie := &http.Cookie{
 				Name:  "AuthCookie",
@@ -232,17 +414,36 @@ func (c *Client) doHttpRequest(api string, method string, payload []byte, conten
 			// logging in (again) and then retry the call.
 			resp.Body.Close()
 			c.logf("API request returned status %d.  Attempting re-auth...", resp.StatusCode)
-			err = c.DoLogin()
+			err = c.reLogin(ctx, authToken)
+			if err != nil {
+				return nil, err
+			}
+			// Now that we have (probably) just logged in, we may
+			// know more about our roles than we did before, and
+			// there's no point retrying if they won't allow it.
+			err = c.checkRole(api)
 			if err != nil {
 				return nil, err
 			}
 			c.logf("Re-auth completed.  Retrying original request.")
+			authToken, err = c.getAuthToken(ctx)
+			if err != nil {
+				return nil, err
+			}
 			cookie := &http.Cookie{
 				Name:  "AuthCookie",
-				Value: c.GetAuthToken(),
+				Value: authToken,
 			}
 			req.Header.Del("Cookie")
 			req.AddCookie(cookie)
+			if req.GetBody != nil {
+				// The original body has already been consumed by
+				// the first attempt.
+				req.Body, err = req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+			}
 			resp, err = c.httpDo(req)
 			if err != nil {
 				return nil, err
@@ -256,6 +457,13 @@ func (c *Client) doHttpRequest(api string, method string, payload []byte, conten
 		return nil, err
 	}
 
+	if strings.HasPrefix(api, "login/") && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		if throttled, ok := checkLoginThrottled(url, resp, body); ok {
+			c.logf("Login throttled: status=%d body=%s retry_after=%s", resp.StatusCode, logBody("", body, resp.Header.Get("Content-Type")), throttled.RetryAfter)
+			return nil, throttled
+		}
+	}
+
 	if resp.StatusCode == 401 || resp.StatusCode == 403 {
 		c.logf("Request failed: status=%d body=%s", resp.StatusCode, logBody("", body, resp.Header.Get("Content-Type")))
 		errInfo := errorResponse{}
@@ -292,32 +500,76 @@ func logBody(api string, body []byte, contentType string) string {
 	}
 }
 
-func (c *Client) apiGetJson(api string, result interface{}) error {
-	respData, err := c.doHttpRequest(api, http.MethodGet, nil, "")
+func (c *Client) apiGetJson(ctx context.Context, api string, result interface{}) error {
+	respData, err := c.doHttpRequest(ctx, api, http.MethodGet, nil, "")
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(respData, result)
-	if err != nil {
-		c.jsonError(api, respData, err)
-		return err
-	}
-	return nil
+	return c.decodeJson(ctx, api, respData, result)
 }
 
-func (c *Client) apiPostJson(api string, payload interface{}, result interface{}) error {
+func (c *Client) apiPostJson(ctx context.Context, api string, payload interface{}, result interface{}) error {
 	payloadData, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	respData, err := c.doHttpRequest(api, http.MethodPost, payloadData, "application/json")
+	respData, err := c.doHttpRequest(ctx, api, http.MethodPost, payloadData, "application/json")
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(respData, result)
-	if err != nil {
-		c.jsonError(api, respData, err)
+	return c.decodeJson(ctx, api, respData, result)
+}
+
+// decodeJson unmarshals an API response into result, handling any fields
+// which could not be decoded according to the client's DecodePolicy.
+func (c *Client) decodeJson(ctx context.Context, api string, data []byte, result interface{}) error {
+	err := json.Unmarshal(data, result)
+	c.checkSchema(ctx, api, data, result)
+	if err == nil && c.decodePolicy != DecodeStrict {
+		return nil
+	}
+	if c.decodePolicy == DecodeFail {
+		c.jsonError(api, data, err)
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if dec.Decode(&raw) != nil {
+		// Not valid JSON at all, so there's no way we can make sense
+		// of it.
+		c.jsonError(api, data, err)
 		return err
 	}
+	w := schemaWalker{}
+	w.walk("", raw, reflect.ValueOf(result))
+	decodeErr := newDecodeError(api, w.diffs, c.decodePolicy == DecodeStrict)
+	if decodeErr == nil {
+		// This shouldn't happen, but if we couldn't figure out what
+		// the problem was, just return the original error.
+		if err != nil {
+			c.jsonError(api, data, err)
+		}
+		return err
+	}
+
+	if c.decodePolicy == DecodeStrict {
+		c.jsonError(api, data, *decodeErr)
+		return *decodeErr
+	}
+	if err != nil {
+		// Try again without the fields which caused problems, so that
+		// we get as much of the rest of it as possible.
+		clean, _ := json.Marshal(raw)
+		if err = json.Unmarshal(clean, result); err != nil {
+			c.jsonError(api, data, err)
+			return err
+		}
+	}
+	c.logf("%s", decodeErr)
+	if c.decodePolicy == DecodeWarn {
+		c.jsonError(api, data, *decodeErr)
+	}
 	return nil
 }
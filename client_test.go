@@ -0,0 +1,169 @@
+package powerwall_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestContextDeadline(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 5 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetSOEContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request was not cut short by the deadline (took %s)", elapsed)
+	}
+}
+
+func TestContextCancelMidRequest(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := client.GetSOEContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+
+	// The client should still work normally afterwards.
+	s.ClearFaults()
+	soe, err := client.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage == 0 {
+		t.Errorf("unexpected SOE %+v", soe)
+	}
+}
+
+func TestContextAlreadyCancelled(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.GetStatusContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if err := client.DoLoginContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled from DoLoginContext, got %v", err)
+	}
+}
+
+func TestCallsAfterClose(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+
+	if _, err := client.GetSOE(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Close returned %v", err)
+	}
+	// Closing again should be harmless.
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	s.ResetRequests()
+	if _, err := client.GetSOE(); !errors.Is(err, powerwall.ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if err := client.DoLogin(); !errors.Is(err, powerwall.ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed from DoLogin, got %v", err)
+	}
+	if token := client.GetAuthToken(); token != "" {
+		t.Errorf("expected no auth token after Close, got %q", token)
+	}
+	if reqs := s.Requests(); len(reqs) != 0 {
+		t.Errorf("requests were made after Close: %+v", reqs)
+	}
+}
+
+func TestCloseDuringRequest(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 5 * time.Second})
+
+	time.AfterFunc(100*time.Millisecond, func() { client.Close() })
+	start := time.Now()
+	_, err := client.GetSOE()
+	if !errors.Is(err, powerwall.ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request was not cancelled by Close (took %s)", elapsed)
+	}
+}
+
+func TestSetOperation(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	op, err := client.SetOperation(powerwall.OperationModeTimeBased, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.RealMode != powerwall.OperationModeTimeBased || op.BackupReservePercent != 30 {
+		t.Errorf("unexpected result %+v", op)
+	}
+	committed := false
+	for _, r := range s.Requests() {
+		if r.API == "config/completed" {
+			committed = true
+		}
+	}
+	if !committed {
+		t.Errorf("settings were not committed with config/completed")
+	}
+
+	op, err = client.GetOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.RealMode != powerwall.OperationModeTimeBased || op.BackupReservePercent != 30 {
+		t.Errorf("settings were not saved: %+v", op)
+	}
+
+	if _, err := client.SetOperation(powerwall.OperationModeSelf, 101); err == nil {
+		t.Errorf("expected an error for an invalid reserve percentage")
+	}
+
+	s.SetFault("operation", powerwalltest.Fault{StatusCode: 400, Count: 1})
+	_, err = client.SetOperation(powerwall.OperationModeSelf, 20)
+	var rejected powerwall.OperationRejected
+	if !errors.As(err, &rejected) {
+		t.Fatalf("expected OperationRejected, got %v", err)
+	}
+	if rejected.Mode != powerwall.OperationModeSelf || rejected.BackupReservePercent != 20 || rejected.Err.StatusCode != 400 {
+		t.Errorf("unexpected error contents %+v", rejected)
+	}
+	var apiErr powerwall.ApiError
+	if !errors.As(err, &apiErr) {
+		t.Errorf("OperationRejected does not unwrap to ApiError")
+	}
+}
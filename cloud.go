@@ -0,0 +1,380 @@
+// Functions for accessing a Powerwall system via Tesla's servers:
+//
+//   NewCloudClient(siteID, accessToken, options...)
+//   (*CloudClient) SetAccessToken(token)
+//   (*CloudClient) GetStatus()
+//   (*CloudClient) GetStatusContext(ctx)
+//   (*CloudClient) GetSOE()
+//   (*CloudClient) GetSOEContext(ctx)
+//   (*CloudClient) GetMetersAggregates()
+//   (*CloudClient) GetMetersAggregatesContext(ctx)
+//   (*CloudClient) GetGridStatus()
+//   (*CloudClient) GetGridStatusContext(ctx)
+//   (*CloudClient) GetOperation()
+//   (*CloudClient) GetOperationContext(ctx)
+//   (*CloudClient) SetOperation(mode, reservePercent)
+//   (*CloudClient) SetOperationContext(ctx, mode, reservePercent)
+//
+package powerwall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCloudBaseURL is the default server used by CloudClient (Tesla's
+// "Owner API").  The Fleet API uses the same endpoints for energy sites, so
+// this can be changed to a Fleet API server using the WithBaseURL option.
+const DefaultCloudBaseURL = "https://owner-api.teslamotors.com"
+
+// CloudClient provides access to a Powerwall system via Tesla's servers,
+// instead of connecting to the gateway directly over the local network.  This
+// is useful as a fallback if the gateway cannot be reached locally, but note
+// that the information available this way is much more limited.
+//
+// CloudClient implements the Gateway interface.
+type CloudClient struct {
+	baseURL     string
+	siteID      string
+	httpClient  http.Client
+	userAgent   string
+	logFunc     func(...interface{})
+	mutex       sync.Mutex
+	accessToken string
+}
+
+// NewCloudClient creates a new CloudClient object.  siteID is the energy site
+// ID of the Powerwall system (as returned by the "products" API call), and
+// accessToken is an OAuth access token for the Tesla account which owns it.
+//
+// This library does not currently handle obtaining or refreshing access
+// tokens.  If the token is refreshed, the new one can be supplied using
+// SetAccessToken.
+//
+// The WithTransport, WithTimeout, WithTLSConfig, WithUserAgent, WithLogger,
+// and WithBaseURL options can be provided to customize how the client
+// connects.  (Other options are ignored.)
+func NewCloudClient(siteID string, accessToken string, options ...Option) *CloudClient {
+	opts := defaultClientOptions()
+	opts.timeout = 10 * time.Second
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.baseURL == "" {
+		opts.baseURL = DefaultCloudBaseURL
+	}
+
+	transport := opts.transport
+	if transport == nil {
+		// We don't want the gateway-specific TLS defaults here, since
+		// Tesla's servers have proper certificates.
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.tlsConfig != nil {
+			tr.TLSClientConfig = opts.tlsConfig.Clone()
+		}
+		transport = tr
+	}
+
+	cc := &CloudClient{
+		baseURL: strings.TrimRight(opts.baseURL, "/"),
+		siteID:  siteID,
+		httpClient: http.Client{
+			Transport: transport,
+			Timeout:   opts.timeout,
+		},
+		userAgent:   opts.userAgent,
+		logFunc:     opts.logFunc,
+		accessToken: accessToken,
+	}
+	cc.logf("New cloud client created: base_url=%s site_id=%s", cc.baseURL, siteID)
+	return cc
+}
+
+func (cc *CloudClient) logf(format string, v ...interface{}) {
+	logFunc := logFunc
+	if cc.logFunc != nil {
+		logFunc = cc.logFunc
+	}
+	logFunc(fmt.Sprintf("{%p} ", cc) + fmt.Sprintf(format, v...))
+}
+
+// SetAccessToken sets the OAuth access token to use for subsequent API calls.
+func (cc *CloudClient) SetAccessToken(token string) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.accessToken = token
+}
+
+func (cc *CloudClient) doRequest(ctx context.Context, method string, api string, payload interface{}, result interface{}) error {
+	u, err := url.Parse(cc.baseURL + "/api/1/energy_sites/" + url.PathEscape(cc.siteID) + "/" + api)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if payload != nil {
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	cc.logf("Calling cloud API: method=%s url=%s body=%s", method, u.String(), logBody(api, body, "application/json"))
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cc.userAgent != "" {
+		req.Header.Set("User-Agent", cc.userAgent)
+	}
+	cc.mutex.Lock()
+	req.Header.Set("Authorization", "Bearer "+cc.accessToken)
+	cc.mutex.Unlock()
+
+	resp, err := cc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		cc.logf("Request failed: status=%d body=%s", resp.StatusCode, logBody("", respData, resp.Header.Get("Content-Type")))
+		return AuthFailure{
+			URL:       *u,
+			ErrorText: http.StatusText(resp.StatusCode),
+			Message:   strings.TrimSpace(string(respData)),
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		cc.logf("Request failed: status=%d body=%s", resp.StatusCode, logBody("", respData, resp.Header.Get("Content-Type")))
+		return ApiError{
+			URL:        *u,
+			StatusCode: resp.StatusCode,
+			Body:       respData,
+		}
+	}
+	cc.logf("Request succeeded: status=%d body=%s", resp.StatusCode, logBody(api, respData, resp.Header.Get("Content-Type")))
+
+	// All responses are wrapped in a {"response": ...} object.
+	wrapper := struct {
+		Response interface{} `json:"response"`
+	}{Response: result}
+	err = json.Unmarshal(respData, &wrapper)
+	if err != nil {
+		errFunc(fmt.Sprintf("Error unmarshalling cloud '%s' response %s", api, string(respData)), err)
+		return err
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// cloudLiveStatus contains the fields returned by the cloud "live_status" API
+// call which we know how to use.
+type cloudLiveStatus struct {
+	SolarPower         float32   `json:"solar_power"`
+	EnergyLeft         float32   `json:"energy_left"`
+	TotalPackEnergy    float32   `json:"total_pack_energy"`
+	PercentageCharged  float32   `json:"percentage_charged"`
+	BatteryPower       float32   `json:"battery_power"`
+	LoadPower          float32   `json:"load_power"`
+	GridStatus         string    `json:"grid_status"`
+	GridPower          float32   `json:"grid_power"`
+	IslandStatus       string    `json:"island_status"`
+	GridServicesPower  float32   `json:"grid_services_power"`
+	GridServicesActive bool      `json:"grid_services_active"`
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+// cloudSiteInfo contains the fields returned by the cloud "site_info" API call
+// which we know how to use.
+type cloudSiteInfo struct {
+	ID                   string  `json:"id"`
+	SiteName             string  `json:"site_name"`
+	BackupReservePercent float32 `json:"backup_reserve_percent"`
+	DefaultRealMode      string  `json:"default_real_mode"`
+	Version              string  `json:"version"`
+}
+
+func (cc *CloudClient) getLiveStatus(ctx context.Context) (*cloudLiveStatus, error) {
+	result := cloudLiveStatus{}
+	err := cc.doRequest(ctx, http.MethodGet, "live_status", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (cc *CloudClient) getSiteInfo(ctx context.Context) (*cloudSiteInfo, error) {
+	result := cloudSiteInfo{}
+	err := cc.doRequest(ctx, http.MethodGet, "site_info", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetStatus returns basic information about the system, for compatibility
+// with (*Client).GetStatus.  Only the Din (which will be the energy site ID)
+// and Version fields are available from the cloud API.
+func (cc *CloudClient) GetStatus() (*StatusData, error) {
+	return cc.GetStatusContext(context.Background())
+}
+
+// GetStatusContext is the same as GetStatus, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (cc *CloudClient) GetStatusContext(ctx context.Context) (*StatusData, error) {
+	info, err := cc.getSiteInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &StatusData{
+		Din:     info.ID,
+		Version: info.Version,
+	}, nil
+}
+
+// GetSOE returns the current "State Of Energy" of the system, for
+// compatibility with (*Client).GetSOE.
+func (cc *CloudClient) GetSOE() (*SOEData, error) {
+	return cc.GetSOEContext(context.Background())
+}
+
+// GetSOEContext is the same as GetSOE, but uses the provided context to allow
+// cancelling or setting a deadline on the request.
+func (cc *CloudClient) GetSOEContext(ctx context.Context) (*SOEData, error) {
+	live, err := cc.getLiveStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SOEData{Percentage: live.PercentageCharged}, nil
+}
+
+// GetMetersAggregates returns the current power flows for each category of
+// connection ("site", "solar", "battery", and "load"), for compatibility with
+// (*Client).GetMetersAggregates.  Only the InstantPower and
+// LastCommunicationTime fields are available from the cloud API.
+func (cc *CloudClient) GetMetersAggregates() (*map[string]MeterAggregatesData, error) {
+	return cc.GetMetersAggregatesContext(context.Background())
+}
+
+// GetMetersAggregatesContext is the same as GetMetersAggregates, but uses the
+// provided context to allow cancelling or setting a deadline on the request.
+func (cc *CloudClient) GetMetersAggregatesContext(ctx context.Context) (*map[string]MeterAggregatesData, error) {
+	live, err := cc.getLiveStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]MeterAggregatesData{
+		"site":    {InstantPower: live.GridPower, LastCommunicationTime: live.Timestamp},
+		"solar":   {InstantPower: live.SolarPower, LastCommunicationTime: live.Timestamp},
+		"battery": {InstantPower: live.BatteryPower, LastCommunicationTime: live.Timestamp},
+		"load":    {InstantPower: live.LoadPower, LastCommunicationTime: live.Timestamp},
+	}
+	return &result, nil
+}
+
+// GetGridStatus returns information about the current state of the system's
+// connection to the utility grid, for compatibility with
+// (*Client).GetGridStatus.  (The cloud API does not report when the system is
+// transitioning back to the grid, so GridStatus will only ever be
+// GridStatusConnected or GridStatusIslanded.)
+func (cc *CloudClient) GetGridStatus() (*GridStatusData, error) {
+	return cc.GetGridStatusContext(context.Background())
+}
+
+// GetGridStatusContext is the same as GetGridStatus, but uses the provided
+// context to allow cancelling or setting a deadline on the request.
+func (cc *CloudClient) GetGridStatusContext(ctx context.Context) (*GridStatusData, error) {
+	live, err := cc.getLiveStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := GridStatusData{
+		GridStatus:         GridStatusConnected,
+		GridServicesActive: live.GridServicesActive,
+	}
+	if strings.HasPrefix(live.IslandStatus, "off_grid") || live.GridStatus == "Inactive" {
+		result.GridStatus = GridStatusIslanded
+	}
+	return &result, nil
+}
+
+// GetOperation returns the current operation mode configuration, for
+// compatibility with (*Client).GetOperation.  Only the RealMode and
+// BackupReservePercent fields are available from the cloud API.
+//
+// Note that the cloud API reports the backup reserve percentage as shown in
+// the Tesla app, which is slightly different from the value used by the local
+// API.  It is converted (using ReservePercentFromApp), so BackupReservePercent
+// is the same raw value (*Client).GetOperation would return.
+func (cc *CloudClient) GetOperation() (*OperationData, error) {
+	return cc.GetOperationContext(context.Background())
+}
+
+// GetOperationContext is the same as GetOperation, but uses the provided
+// context to allow cancelling or setting a deadline on the request.
+func (cc *CloudClient) GetOperationContext(ctx context.Context) (*OperationData, error) {
+	info, err := cc.getSiteInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &OperationData{
+		RealMode:             info.DefaultRealMode,
+		BackupReservePercent: ReservePercentFromApp(info.BackupReservePercent),
+	}, nil
+}
+
+// SetOperation changes the operation mode and backup reserve percentage of the
+// system, for compatibility with (*Client).SetOperation.  As with
+// (*Client).SetOperation, reservePercent is the raw value used by the local
+// API, and is converted (using ReservePercentToApp) to the percentage shown in
+// the Tesla app before sending it to the cloud API.
+//
+// On success, the updated settings are returned.
+func (cc *CloudClient) SetOperation(mode string, reservePercent float32) (*OperationData, error) {
+	return cc.SetOperationContext(context.Background(), mode, reservePercent)
+}
+
+// SetOperationContext is the same as SetOperation, but uses the provided
+// context to allow cancelling or setting a deadline on the requests.
+func (cc *CloudClient) SetOperationContext(ctx context.Context, mode string, reservePercent float32) (*OperationData, error) {
+	type operationRequest struct {
+		DefaultRealMode string `json:"default_real_mode"`
+	}
+	type backupRequest struct {
+		BackupReservePercent float32 `json:"backup_reserve_percent"`
+	}
+
+	if reservePercent < 0 || reservePercent > 100 {
+		return nil, fmt.Errorf("invalid backup reserve percentage %v (must be between 0 and 100)", reservePercent)
+	}
+	if mode == "" {
+		return nil, fmt.Errorf("no operation mode specified")
+	}
+
+	var ignored interface{}
+	err := cc.doRequest(ctx, http.MethodPost, "operation", operationRequest{DefaultRealMode: mode}, &ignored)
+	if err != nil {
+		return nil, err
+	}
+	err = cc.doRequest(ctx, http.MethodPost, "backup", backupRequest{BackupReservePercent: ReservePercentToApp(reservePercent)}, &ignored)
+	if err != nil {
+		return nil, err
+	}
+	return cc.GetOperationContext(ctx)
+}
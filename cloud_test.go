@@ -0,0 +1,115 @@
+package powerwall_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestReservePercentConversion(t *testing.T) {
+	for _, app := range []float32{0, 20, 50, 100} {
+		raw := powerwall.ReservePercentFromApp(app)
+		if back := powerwall.ReservePercentToApp(raw); math.Abs(float64(back-app)) > 0.001 {
+			t.Errorf("app %v -> raw %v -> app %v", app, raw, back)
+		}
+	}
+	if raw := powerwall.ReservePercentFromApp(20); raw != 24 {
+		t.Errorf("expected app 20%% to be raw 24%%, got %v", raw)
+	}
+}
+
+func TestCloudClient(t *testing.T) {
+	s := powerwalltest.NewCloudServer()
+	defer s.Close()
+	var gw powerwall.Gateway = s.NewClient(powerwall.WithLogger(t.Log))
+
+	status, err := gw.GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Din != powerwalltest.DefaultSiteID {
+		t.Errorf("unexpected Din %q", status.Din)
+	}
+
+	soe, err := gw.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage != 75 {
+		t.Errorf("unexpected SOE %v", soe.Percentage)
+	}
+
+	meters, err := gw.GetMetersAggregates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*meters)["solar"].InstantPower != 3000 || (*meters)["load"].InstantPower != 2000 {
+		t.Errorf("unexpected meters %+v", *meters)
+	}
+
+	s.SetField("live_status", "island_status", "off_grid_intentional")
+	grid, err := gw.GetGridStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.GridStatus != powerwall.GridStatusIslanded {
+		t.Errorf("unexpected grid status %q", grid.GridStatus)
+	}
+}
+
+func TestCloudClientOperationUnits(t *testing.T) {
+	s := powerwalltest.NewCloudServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+
+	// The fake server stores the app's 20%, which is a raw 24%.
+	op, err := client.GetOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.BackupReservePercent != 24 || op.RealMode != powerwall.OperationModeSelf {
+		t.Errorf("unexpected operation %+v", op)
+	}
+
+	op, err = client.SetOperation(powerwall.OperationModeTimeBased, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app, ok := s.Field("site_info", "backup_reserve_percent").(float64); !ok || math.Abs(app-40) > 0.001 {
+		t.Errorf("expected the cloud to be sent the app's 40%%, got %v", s.Field("site_info", "backup_reserve_percent"))
+	}
+	if math.Abs(float64(op.BackupReservePercent-43)) > 0.001 || op.RealMode != powerwall.OperationModeTimeBased {
+		t.Errorf("unexpected operation %+v", op)
+	}
+
+	// The same raw value should mean the same thing for the local API.
+	local := powerwalltest.NewServer()
+	defer local.Close()
+	localOp, err := local.NewClient(powerwall.WithLogger(t.Log)).SetOperation(powerwall.OperationModeTimeBased, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localOp.BackupReservePercent != 43 {
+		t.Errorf("unexpected local operation %+v", localOp)
+	}
+}
+
+func TestCloudClientAuthFailure(t *testing.T) {
+	s := powerwalltest.NewCloudServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	s.SetAccessToken("new-token")
+
+	_, err := client.GetSOE()
+	var authErr powerwall.AuthFailure
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected AuthFailure, got %v", err)
+	}
+	client.SetAccessToken("new-token")
+	if _, err := client.GetSOE(); err != nil {
+		t.Errorf("request failed after updating token: %v", err)
+	}
+}
@@ -8,12 +8,11 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
-	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -25,13 +24,18 @@ var options struct {
 	Debug         bool          `long:"debug" description:"Enable debug messages"`
 	Address       string        `long:"address" required:"true" description:"IP address or hostname of Powerwall gateway (required)"`
 	Email         string        `long:"email" description:"Email address to use when logging in"`
-	Password      string        `long:"password" description:"Password to use when logging in"`
+	Password      string        `long:"password" description:"Password to use when logging in (note: this will be visible to other users in the process list; consider one of the other --password-* options instead)"`
+	PasswordFile  string        `long:"password-file" description:"Read the password from the specified file"`
+	PasswordEnv   string        `long:"password-env" description:"Read the password from the specified environment variable"`
+	PasswordCmd   string        `long:"password-command" description:"Run the specified shell command to get the password (e.g. 'pass show powerwall')"`
+	SerialPass    bool          `long:"serial-password" description:"Use the gateway's default password (the last 5 characters of its serial number)"`
 	AuthCache     string        `long:"authcache" description:"Filename to store/load auth token"`
 	CertFile      string        `long:"certfile" description:"Filename of TLS certificate to use for validation"`
 	RetryTimeout  time.Duration `long:"retry-timeout" description:"How long to keep trying to reach the gateway before giving up (default: no retries)"`
 	RetryInterval time.Duration `long:"retry-interval" description:"How long to wait between retries" default:"1s"`
+	MQTT          mqttOptions   `group:"MQTT Options (for 'mqtt' command)"`
 	Args          struct {
-		Command string   `positional-arg-name:"command" description:"One of 'status', 'login', 'site_info', 'fetchcert', 'aggregates', 'meters', 'system_status', 'grid_faults', 'grid_status', 'soe', 'operation', 'sitemaster', 'networks'"`
+		Command string   `positional-arg-name:"command" description:"One of 'status', 'login', 'site_info', 'fetchcert', 'aggregates', 'meters', 'system_status', 'grid_faults', 'grid_status', 'go_off_grid', 'go_on_grid', 'soe', 'operation', 'set_operation', 'sitemaster', 'stop_sitemaster', 'start_sitemaster', 'networks', 'vitals', 'mqtt'"`
 		Args    []string `positional-arg-name:"args" description:"Optional arguments depending on command"`
 	} `positional-args:"true" required:"true"`
 }
@@ -44,6 +48,27 @@ func logError(msg string, err error) {
 	log.WithFields(log.Fields{"err": err}).Error(msg)
 }
 
+// credentials returns the CredentialProvider to use, based on the command-line
+// options.
+func credentials() powerwall.CredentialProvider {
+	switch {
+	case options.PasswordFile != "":
+		return powerwall.NewFileCredentials(options.Email, options.PasswordFile)
+	case options.PasswordEnv != "":
+		creds := powerwall.NewEnvCredentials("", options.PasswordEnv)
+		creds.Email = options.Email
+		return creds
+	case options.PasswordCmd != "":
+		return powerwall.NewCommandCredentials(options.Email, "sh", "-c", options.PasswordCmd)
+	case options.SerialPass:
+		// The client will look up the serial number itself when it
+		// logs in.
+		return powerwall.NewSerialCredentials(options.Email, "")
+	default:
+		return powerwall.StaticCredentials{Email: options.Email, Password: options.Password}
+	}
+}
+
 func main() {
 	var err error
 
@@ -58,7 +83,11 @@ func main() {
 	powerwall.SetLogFunc(logDebug)
 	powerwall.SetErrFunc(logError)
 
-	c := powerwall.NewClient(options.Address, options.Email, options.Password)
+	clientOptions := []powerwall.Option{powerwall.WithCredentials(credentials())}
+	if options.AuthCache != "" {
+		clientOptions = append(clientOptions, powerwall.WithTokenStore(powerwall.NewFileTokenStore(options.AuthCache)))
+	}
+	c := powerwall.NewClientWithOptions(options.Address, clientOptions...)
 	c.SetRetry(options.RetryInterval, options.RetryTimeout)
 
 	if options.CertFile != "" && options.Args.Command != "fetchcert" {
@@ -78,22 +107,11 @@ func main() {
 			os.Exit(2)
 		}
 
-		c.SetTLSCert(cert)
-	}
-
-	authToken := ""
-	if options.AuthCache != "" {
-		authdata, err := ioutil.ReadFile(options.AuthCache)
+		err = c.TrySetTLSCert(cert)
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				// This is ok
-			} else {
-				fmt.Fprintf(os.Stderr, "Cannot read authcache file: %s\n", err)
-				os.Exit(2)
-			}
+			fmt.Fprintf(os.Stderr, "Cannot use cert file: %s\n", err)
+			os.Exit(2)
 		}
-		authToken = strings.TrimSpace(string(authdata))
-		c.SetAuthToken(authToken)
 	}
 
 	switch options.Args.Command {
@@ -158,6 +176,16 @@ func main() {
 			panic(err)
 		}
 		writeResult(result)
+	case "go_off_grid":
+		err := c.GoOffGrid()
+		if err != nil {
+			panic(err)
+		}
+	case "go_on_grid":
+		err := c.GoOnGrid()
+		if err != nil {
+			panic(err)
+		}
 	case "soe":
 		result, err := c.GetSOE()
 		if err != nil {
@@ -170,31 +198,60 @@ func main() {
 			panic(err)
 		}
 		writeResult(result)
+	case "set_operation":
+		if len(options.Args.Args) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: set_operation <mode> <backup_reserve_percent>")
+			os.Exit(3)
+		}
+		reserve, err := strconv.ParseFloat(options.Args.Args[1], 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid backup reserve percentage: %s\n", options.Args.Args[1])
+			os.Exit(3)
+		}
+		result, err := c.SetOperation(options.Args.Args[0], float32(reserve))
+		if err != nil {
+			panic(err)
+		}
+		writeResult(result)
 	case "sitemaster":
 		result, err := c.GetSitemaster()
 		if err != nil {
 			panic(err)
 		}
 		writeResult(result)
+	case "stop_sitemaster":
+		force := len(options.Args.Args) > 0 && options.Args.Args[0] == "force"
+		err := c.StopSitemaster(force)
+		if err != nil {
+			panic(err)
+		}
+	case "start_sitemaster":
+		err := c.StartSitemaster()
+		if err != nil {
+			panic(err)
+		}
 	case "networks":
 		result, err := c.GetNetworks()
 		if err != nil {
 			panic(err)
 		}
 		writeResult(result)
+	case "mqtt":
+		err := runMQTT(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(2)
+		}
+	case "vitals":
+		result, err := c.GetVitals()
+		if err != nil {
+			panic(err)
+		}
+		writeResult(result)
 	default:
 		fmt.Fprintf(os.Stderr, "Error: Unknown command: %v\n", options.Args.Command)
 		os.Exit(3)
 	}
-
-	newAuthToken := c.GetAuthToken()
-	if newAuthToken != authToken && options.AuthCache != "" {
-		// Auth token has changed.  Write it out to the cache file.
-		err := os.WriteFile(options.AuthCache, []byte(newAuthToken), 0600)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Cannot write to authcache file: %s\n", err)
-		}
-	}
 }
 
 func writeResult(value interface{}) {
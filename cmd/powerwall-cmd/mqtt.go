@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// The 'mqtt' command runs as a daemon, periodically polling the gateway and
+// publishing the results to an MQTT broker (along with Home Assistant MQTT
+// discovery messages, so the values show up in Home Assistant automatically).
+// It also subscribes to command topics for changing the operation mode and
+// backup reserve.
+//
+// Topics published (under the configured topic prefix):
+//
+//   availability                      "online" or "offline"
+//   soe                               Battery charge percentage
+//   power/<category>                  Instant power (W) for site/solar/battery/load
+//   energy/<category>/exported        Total energy exported (Wh)
+//   energy/<category>/imported        Total energy imported (Wh)
+//   grid_status                       Grid status (see powerwall.GridStatus*)
+//   grid_connected                    "ON" or "OFF"
+//   operation/mode                    Operation mode (see powerwall.OperationMode*)
+//   operation/backup_reserve_percent  Backup reserve percentage (as shown in the Tesla app)
+//
+// Command topics subscribed:
+//
+//   operation/mode/set
+//   operation/backup_reserve_percent/set  (also as shown in the Tesla app)
+//
+// (The backup reserve is converted to and from the raw value used by the
+// gateway's API using powerwall.ReservePercentToApp and ReservePercentFromApp,
+// so it matches what users see in the app.)
+
+type mqttOptions struct {
+	Broker          string        `long:"mqtt-broker" description:"URL of MQTT broker" default:"tcp://localhost:1883"`
+	ClientID        string        `long:"mqtt-client-id" description:"Client ID to use when connecting to the MQTT broker" default:"powerwall"`
+	Username        string        `long:"mqtt-username" description:"Username for the MQTT broker"`
+	Password        string        `long:"mqtt-password" description:"Password for the MQTT broker"`
+	TopicPrefix     string        `long:"mqtt-topic-prefix" description:"Prefix for all published/subscribed topics" default:"powerwall"`
+	DiscoveryPrefix string        `long:"mqtt-discovery-prefix" description:"Home Assistant discovery topic prefix (empty to disable discovery)" default:"homeassistant"`
+	PollInterval    time.Duration `long:"mqtt-poll-interval" description:"How often to poll the gateway and publish values" default:"30s"`
+}
+
+var meterCategories = []string{"site", "solar", "battery", "load"}
+
+type mqttPublisher struct {
+	client   *powerwall.Client
+	mqtt     mqtt.Client
+	prefix   string
+	status   *powerwall.StatusData
+	siteName string
+	// Commands are processed on the main loop, so that we're never talking
+	// to the gateway from more than one place at a time.
+	commands chan mqtt.Message
+}
+
+func newMQTTPublisher(c *powerwall.Client, prefix string) *mqttPublisher {
+	return &mqttPublisher{
+		client:   c,
+		prefix:   strings.TrimSuffix(prefix, "/"),
+		commands: make(chan mqtt.Message, 10),
+	}
+}
+
+func (p *mqttPublisher) topic(parts ...string) string {
+	return p.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (p *mqttPublisher) publish(topic string, retained bool, payload string) {
+	token := p.mqtt.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		log.WithFields(log.Fields{"topic": topic}).Warn("MQTT publish timed out")
+	} else if token.Error() != nil {
+		log.WithFields(log.Fields{"err": token.Error(), "topic": topic}).Error("MQTT publish failed")
+	}
+}
+
+// capitalize returns s with its first letter in upper case.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// init fetches the information about the gateway which is needed for
+// publishing discovery messages.
+func (p *mqttPublisher) init() error {
+	var err error
+	p.status, err = p.client.GetStatus()
+	if err != nil {
+		return fmt.Errorf("cannot get gateway status: %w", err)
+	}
+	siteInfo, err := p.client.GetSiteInfo()
+	if err != nil {
+		return fmt.Errorf("cannot get site info: %w", err)
+	}
+	p.siteName = siteInfo.SiteName
+	return nil
+}
+
+// onConnect is called whenever we (re-)connect to the MQTT broker.  It
+// (re-)subscribes to the command topics and (re-)announces ourselves, in case
+// the broker has restarted.
+func (p *mqttPublisher) onConnect(client mqtt.Client, discoveryPrefix string) {
+	for _, t := range []string{p.topic("operation", "mode", "set"), p.topic("operation", "backup_reserve_percent", "set")} {
+		client.Subscribe(t, 1, func(_ mqtt.Client, msg mqtt.Message) {
+			p.queueCommand(msg)
+		})
+	}
+	if discoveryPrefix != "" {
+		p.publishDiscovery(discoveryPrefix)
+	}
+	p.publish(p.topic("availability"), true, "online")
+}
+
+// queueCommand queues a received command message to be processed by the main
+// loop.  This is called from the MQTT client's message handler, which must not
+// block, so if the queue is full, the command is dropped.
+func (p *mqttPublisher) queueCommand(msg mqtt.Message) {
+	select {
+	case p.commands <- msg:
+	default:
+		log.WithFields(log.Fields{"topic": msg.Topic(), "payload": string(msg.Payload())}).Warn("Too many commands queued.  Dropping command.")
+	}
+}
+
+// run polls the gateway at the specified interval, and processes any commands
+// received, until something is received on stop.
+func (p *mqttPublisher) run(interval time.Duration, stop <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	p.poll()
+	for {
+		select {
+		case <-ticker.C:
+			p.poll()
+		case msg := <-p.commands:
+			p.handleCommand(msg)
+		case <-stop:
+			log.Info("Shutting down")
+			p.publish(p.topic("availability"), true, "offline")
+			return
+		}
+	}
+}
+
+// runMQTT runs the 'mqtt' command.
+func runMQTT(c *powerwall.Client) error {
+	opts := options.MQTT
+	if opts.PollInterval <= 0 {
+		return fmt.Errorf("invalid poll interval %s (must be greater than zero)", opts.PollInterval)
+	}
+	p := newMQTTPublisher(c, opts.TopicPrefix)
+	err := p.init()
+	if err != nil {
+		return err
+	}
+
+	mqttOpts := mqtt.NewClientOptions()
+	mqttOpts.AddBroker(opts.Broker)
+	mqttOpts.SetClientID(opts.ClientID)
+	mqttOpts.SetUsername(opts.Username)
+	mqttOpts.SetPassword(opts.Password)
+	mqttOpts.SetAutoReconnect(true)
+	mqttOpts.SetWill(p.topic("availability"), "offline", 1, true)
+	mqttOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Info("Connected to MQTT broker")
+		p.onConnect(client, opts.DiscoveryPrefix)
+	})
+	p.mqtt = mqtt.NewClient(mqttOpts)
+	token := p.mqtt.Connect()
+	token.Wait()
+	if token.Error() != nil {
+		return fmt.Errorf("cannot connect to MQTT broker: %w", token.Error())
+	}
+	defer p.mqtt.Disconnect(1000)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	p.run(opts.PollInterval, signals)
+	return nil
+}
+
+func formatFloat(v float32) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 32)
+}
+
+// poll fetches the current values from the gateway and publishes them.
+func (p *mqttPublisher) poll() {
+	soe, err := p.client.GetSOE()
+	if err == nil {
+		p.publish(p.topic("soe"), false, formatFloat(soe.Percentage))
+	} else {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot get SOE")
+	}
+
+	aggregates, err := p.client.GetMetersAggregates()
+	if err == nil {
+		for category, a := range *aggregates {
+			p.publish(p.topic("power", category), false, formatFloat(a.InstantPower))
+			p.publish(p.topic("energy", category, "exported"), false, formatFloat(a.EnergyExported))
+			p.publish(p.topic("energy", category, "imported"), false, formatFloat(a.EnergyImported))
+		}
+	} else {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot get meter aggregates")
+	}
+
+	gridStatus, err := p.client.GetGridStatus()
+	if err == nil {
+		p.publish(p.topic("grid_status"), false, gridStatus.GridStatus)
+		connected := "OFF"
+		if gridStatus.GridStatus == powerwall.GridStatusConnected {
+			connected = "ON"
+		}
+		p.publish(p.topic("grid_connected"), false, connected)
+	} else {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot get grid status")
+	}
+
+	op, err := p.client.GetOperation()
+	if err == nil {
+		p.publishOperation(op)
+	} else {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot get operation")
+	}
+}
+
+func (p *mqttPublisher) publishOperation(op *powerwall.OperationData) {
+	// The app only deals in whole percentages, so round off any error
+	// from the conversion.
+	reserve := float32(math.Round(float64(powerwall.ReservePercentToApp(op.BackupReservePercent))))
+	p.publish(p.topic("operation", "mode"), true, op.RealMode)
+	p.publish(p.topic("operation", "backup_reserve_percent"), true, formatFloat(reserve))
+}
+
+// handleCommand processes a message received on one of the command topics.
+func (p *mqttPublisher) handleCommand(msg mqtt.Message) {
+	payload := strings.TrimSpace(string(msg.Payload()))
+	log.WithFields(log.Fields{"topic": msg.Topic(), "payload": payload}).Info("Received command")
+
+	op, err := p.client.GetOperation()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot get current operation settings")
+		return
+	}
+	mode := op.RealMode
+	reserve := op.BackupReservePercent
+
+	switch msg.Topic() {
+	case p.topic("operation", "mode", "set"):
+		mode = payload
+	case p.topic("operation", "backup_reserve_percent", "set"):
+		v, err := strconv.ParseFloat(payload, 32)
+		if err != nil || v < 0 || v > 100 {
+			log.WithFields(log.Fields{"payload": payload}).Error("Invalid backup reserve percentage")
+			return
+		}
+		reserve = powerwall.ReservePercentFromApp(float32(v))
+	default:
+		return
+	}
+
+	newOp, err := p.client.SetOperation(mode, reserve)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Cannot change operation settings")
+		// Make sure the published state reflects what the gateway
+		// actually has, not what was requested.
+		p.publishOperation(op)
+		return
+	}
+	p.publishOperation(newOp)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// publishDiscovery publishes Home Assistant MQTT discovery configs for all of
+// the values we publish.
+func (p *mqttPublisher) publishDiscovery(discoveryPrefix string) {
+	din := p.status.Din
+	device := map[string]interface{}{
+		"identifiers":  []string{din},
+		"name":         "Powerwall " + p.siteName,
+		"manufacturer": "Tesla",
+		"model":        p.status.DeviceType,
+		"sw_version":   p.status.Version,
+	}
+	// Home Assistant doesn't like some characters in object IDs.
+	nodeID := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, din)
+
+	announce := func(component string, objectID string, config map[string]interface{}) {
+		config["unique_id"] = nodeID + "_" + objectID
+		config["object_id"] = "powerwall_" + objectID
+		config["device"] = device
+		config["availability_topic"] = p.topic("availability")
+		data, err := json.Marshal(config)
+		if err != nil {
+			panic(err)
+		}
+		p.publish(strings.Join([]string{discoveryPrefix, component, nodeID, objectID, "config"}, "/"), true, string(data))
+	}
+
+	announce("sensor", "soe", map[string]interface{}{
+		"name":                "Battery charge",
+		"state_topic":         p.topic("soe"),
+		"unit_of_measurement": "%",
+		"device_class":        "battery",
+		"state_class":         "measurement",
+	})
+	for _, category := range meterCategories {
+		announce("sensor", "power_"+category, map[string]interface{}{
+			"name":                capitalize(category) + " power",
+			"state_topic":         p.topic("power", category),
+			"unit_of_measurement": "W",
+			"device_class":        "power",
+			"state_class":         "measurement",
+		})
+		for _, direction := range []string{"exported", "imported"} {
+			announce("sensor", "energy_"+category+"_"+direction, map[string]interface{}{
+				"name":                capitalize(category) + " energy " + direction,
+				"state_topic":         p.topic("energy", category, direction),
+				"unit_of_measurement": "Wh",
+				"device_class":        "energy",
+				"state_class":         "total_increasing",
+			})
+		}
+	}
+	announce("sensor", "grid_status", map[string]interface{}{
+		"name":        "Grid status",
+		"state_topic": p.topic("grid_status"),
+	})
+	announce("binary_sensor", "grid_connected", map[string]interface{}{
+		"name":         "Grid connected",
+		"state_topic":  p.topic("grid_connected"),
+		"device_class": "power",
+	})
+	announce("select", "operation_mode", map[string]interface{}{
+		"name":          "Operation mode",
+		"state_topic":   p.topic("operation", "mode"),
+		"command_topic": p.topic("operation", "mode", "set"),
+		"options":       []string{powerwall.OperationModeSelf, powerwall.OperationModeTimeBased},
+	})
+	announce("number", "backup_reserve_percent", map[string]interface{}{
+		"name":                "Backup reserve",
+		"state_topic":         p.topic("operation", "backup_reserve_percent"),
+		"command_topic":       p.topic("operation", "backup_reserve_percent", "set"),
+		"min":                 0,
+		"max":                 100,
+		"step":                1,
+		"unit_of_measurement": "%",
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+// fakeBroker is an in-process stand-in for an MQTT broker (and the client
+// connection to it).  It records everything published, and delivers published
+// messages to any matching subscriptions (exact topic matches only).
+type fakeBroker struct {
+	mutex    sync.Mutex
+	retained map[string]string
+	messages []fakeMessage
+	subs     map[string]mqtt.MessageHandler
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		retained: map[string]string{},
+		subs:     map[string]mqtt.MessageHandler{},
+	}
+}
+
+func (b *fakeBroker) last(topic string) (string, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := len(b.messages) - 1; i >= 0; i-- {
+		if b.messages[i].topic == topic {
+			return string(b.messages[i].payload), true
+		}
+	}
+	return "", false
+}
+
+func (b *fakeBroker) IsConnected() bool      { return true }
+func (b *fakeBroker) IsConnectionOpen() bool { return true }
+func (b *fakeBroker) Connect() mqtt.Token    { return doneToken{} }
+func (b *fakeBroker) Disconnect(uint)        {}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch v := payload.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	}
+	msg := fakeMessage{topic: topic, payload: data, retained: retained}
+	b.mutex.Lock()
+	b.messages = append(b.messages, msg)
+	if retained {
+		b.retained[topic] = string(data)
+	}
+	handler := b.subs[topic]
+	b.mutex.Unlock()
+	if handler != nil {
+		handler(b, msg)
+	}
+	return doneToken{}
+}
+
+func (b *fakeBroker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subs[topic] = callback
+	return doneToken{}
+}
+
+func (b *fakeBroker) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		b.Subscribe(topic, qos, callback)
+	}
+	return doneToken{}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, topic := range topics {
+		delete(b.subs, topic)
+	}
+	return doneToken{}
+}
+
+func (b *fakeBroker) AddRoute(topic string, callback mqtt.MessageHandler) {}
+
+func (b *fakeBroker) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// doneToken is an mqtt.Token for an operation which has already completed
+// successfully.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return m.retained }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+func newTestPublisher(t *testing.T) (*powerwalltest.Server, *fakeBroker, *mqttPublisher) {
+	s := powerwalltest.NewServer()
+	t.Cleanup(s.Close)
+	client := s.NewClient()
+	t.Cleanup(func() { client.Close() })
+
+	broker := newFakeBroker()
+	p := newMQTTPublisher(client, "powerwall/")
+	p.mqtt = broker
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	p.onConnect(broker, "homeassistant")
+	return s, broker, p
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	_, broker, _ := newTestPublisher(t)
+
+	// The default fixture's DIN is "1232100-00-E--TG000000000000"
+	node := "1232100_00_E__TG000000000000"
+	payload, ok := broker.retained["homeassistant/sensor/"+node+"/power_solar/config"]
+	if !ok {
+		t.Fatalf("no discovery config published for solar power (published: %v)", broker.retained)
+	}
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["name"] != "Solar power" || config["state_topic"] != "powerwall/power/solar" || config["unique_id"] != node+"_power_solar" {
+		t.Errorf("unexpected solar power config: %v", config)
+	}
+	if config["availability_topic"] != "powerwall/availability" {
+		t.Errorf("unexpected availability topic: %v", config["availability_topic"])
+	}
+
+	payload = broker.retained["homeassistant/number/"+node+"/backup_reserve_percent/config"]
+	config = map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["command_topic"] != "powerwall/operation/backup_reserve_percent/set" || config["min"] != 0.0 || config["max"] != 100.0 {
+		t.Errorf("unexpected backup reserve config: %v", config)
+	}
+
+	if broker.retained["powerwall/availability"] != "online" {
+		t.Errorf("availability not published")
+	}
+}
+
+func TestMQTTPoll(t *testing.T) {
+	s, broker, p := newTestPublisher(t)
+	s.SetFixture("operation", powerwall.OperationData{RealMode: powerwall.OperationModeSelf, BackupReservePercent: 24})
+
+	p.poll()
+	for topic, expected := range map[string]string{
+		"powerwall/grid_connected":                   "ON",
+		"powerwall/operation/mode":                   powerwall.OperationModeSelf,
+		"powerwall/operation/backup_reserve_percent": "20",
+	} {
+		if value, _ := broker.last(topic); value != expected {
+			t.Errorf("%s: expected %q, got %q", topic, expected, value)
+		}
+	}
+	for _, topic := range []string{"powerwall/soe", "powerwall/power/site", "powerwall/energy/solar/exported"} {
+		if _, ok := broker.last(topic); !ok {
+			t.Errorf("nothing published to %s", topic)
+		}
+	}
+}
+
+func TestMQTTCommands(t *testing.T) {
+	s, broker, p := newTestPublisher(t)
+	s.SetFixture("operation", powerwall.OperationData{RealMode: powerwall.OperationModeSelf, BackupReservePercent: 24})
+
+	broker.Publish("powerwall/operation/backup_reserve_percent/set", 1, false, "40")
+	broker.Publish("powerwall/operation/mode/set", 1, false, powerwall.OperationModeTimeBased)
+	broker.Publish("powerwall/operation/backup_reserve_percent/set", 1, false, "bogus")
+	if len(p.commands) != 3 {
+		t.Fatalf("expected 3 queued commands, got %d", len(p.commands))
+	}
+	for len(p.commands) > 0 {
+		p.handleCommand(<-p.commands)
+	}
+
+	op, err := p.client.GetOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 40% in the app is a raw 43%.
+	if op.RealMode != powerwall.OperationModeTimeBased || op.BackupReservePercent != 43 {
+		t.Errorf("unexpected operation settings %+v", op)
+	}
+	if value, _ := broker.last("powerwall/operation/backup_reserve_percent"); value != "40" {
+		t.Errorf("backup reserve published as %q", value)
+	}
+
+	// Handling a command should not poll everything else.
+	for _, r := range s.Requests() {
+		if r.API == "meters/aggregates" {
+			t.Errorf("command handling polled %s", r.API)
+		}
+	}
+}
+
+func TestMQTTCommandQueueFull(t *testing.T) {
+	_, broker, p := newTestPublisher(t)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(p.commands)+5; i++ {
+			broker.Publish("powerwall/operation/mode/set", 1, false, powerwall.OperationModeSelf)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing commands blocked when the queue was full")
+	}
+	if len(p.commands) != cap(p.commands) {
+		t.Errorf("expected a full queue, got %d", len(p.commands))
+	}
+}
+
+func TestCapitalize(t *testing.T) {
+	for in, out := range map[string]string{"solar": "Solar", "": "", "s": "S"} {
+		if got := capitalize(in); got != out {
+			t.Errorf("capitalize(%q) = %q", in, got)
+		}
+	}
+}
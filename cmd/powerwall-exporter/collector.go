@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/foogod/go-powerwall"
+)
+
+const namespace = "powerwall"
+
+// snapshot contains all of the data fetched from the gateway in a single
+// collection pass.
+type snapshot struct {
+	status       *powerwall.StatusData
+	siteInfo     *powerwall.SiteInfoData
+	aggregates   *map[string]powerwall.MeterAggregatesData
+	systemStatus *powerwall.SystemStatusData
+	gridStatus   *powerwall.GridStatusData
+	soe          *powerwall.SOEData
+	time         time.Time
+}
+
+func fetchSnapshot(c *powerwall.Client) (*snapshot, error) {
+	var err error
+	s := &snapshot{}
+
+	if s.status, err = c.GetStatus(); err != nil {
+		return nil, err
+	}
+	if s.siteInfo, err = c.GetSiteInfo(); err != nil {
+		return nil, err
+	}
+	if s.aggregates, err = c.GetMetersAggregates(); err != nil {
+		return nil, err
+	}
+	if s.systemStatus, err = c.GetSystemStatus(); err != nil {
+		return nil, err
+	}
+	if s.gridStatus, err = c.GetGridStatus(); err != nil {
+		return nil, err
+	}
+	if s.soe, err = c.GetSOE(); err != nil {
+		return nil, err
+	}
+	s.time = time.Now()
+	return s, nil
+}
+
+// collector implements prometheus.Collector, producing metrics from the
+// gateway data.  If poll has been started, metrics are produced from the most
+// recent snapshot it fetched.  Otherwise, a new snapshot is fetched for every
+// scrape.  If the most recent attempt to fetch a snapshot failed, only the
+// "up" metric (and the exporter's own metrics) are produced.
+type collector struct {
+	client    *powerwall.Client
+	mutex     sync.Mutex
+	polling   bool
+	last      *snapshot
+	lastErr   error
+	scrapes   prometheus.Counter
+	failures  prometheus.Counter
+	durations prometheus.Histogram
+}
+
+func newCollector(c *powerwall.Client) *collector {
+	return &collector{
+		client: c,
+		scrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_collections_total",
+			Help:      "Total number of times data has been collected from the gateway.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "exporter_collection_failures_total",
+			Help:      "Total number of failed attempts to collect data from the gateway.",
+		}),
+		durations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "exporter_collection_duration_seconds",
+			Help:      "How long it took to collect data from the gateway.",
+		}),
+	}
+}
+
+// update fetches a new snapshot from the gateway and records it (or the error
+// which occurred).
+func (c *collector) update() {
+	start := time.Now()
+	s, err := fetchSnapshot(c.client)
+	c.durations.Observe(time.Since(start).Seconds())
+	c.scrapes.Inc()
+	if err != nil {
+		c.failures.Inc()
+		log.WithFields(log.Fields{"err": err}).Error("Failed to collect data from gateway")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastErr = err
+	if err == nil {
+		c.last = s
+	}
+}
+
+// poll updates the snapshot at the specified interval, forever.
+func (c *collector) poll(interval time.Duration) {
+	c.mutex.Lock()
+	c.polling = true
+	c.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.update()
+		<-ticker.C
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.scrapes.Desc()
+	ch <- c.failures.Desc()
+	ch <- c.durations.Desc()
+	ch <- upDesc
+	for _, desc := range allDescs {
+		ch <- desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	polling := c.polling
+	c.mutex.Unlock()
+	if !polling {
+		c.update()
+	}
+
+	c.mutex.Lock()
+	s := c.last
+	lastErr := c.lastErr
+	c.mutex.Unlock()
+
+	ch <- c.scrapes
+	ch <- c.failures
+	ch <- c.durations
+
+	if lastErr != nil || s == nil {
+		// Don't report the values from an earlier collection as if they
+		// were current.  Just say we're down.
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1)
+	newMetrics(s, ch).collect()
+}
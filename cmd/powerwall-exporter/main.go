@@ -0,0 +1,132 @@
+// powerwall-exporter is a Prometheus exporter which uses the powerwall module
+// to collect metrics from a Tesla Powerwall gateway.
+//
+// By default, data is fetched from the gateway each time Prometheus scrapes
+// the /metrics endpoint.  Alternatively, the --poll-interval option can be used
+// to fetch data in the background on a fixed schedule instead, in which case
+// scrapes just return the most recently fetched values.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/foogod/go-powerwall"
+)
+
+var options struct {
+	Debug         bool          `long:"debug" description:"Enable debug messages"`
+	Address       string        `long:"address" required:"true" description:"IP address or hostname of Powerwall gateway (required)"`
+	Email         string        `long:"email" description:"Email address to use when logging in"`
+	PasswordFile  string        `long:"password-file" description:"Read the password from the specified file"`
+	PasswordEnv   string        `long:"password-env" description:"Read the password from the specified environment variable"`
+	PasswordCmd   string        `long:"password-command" description:"Run the specified shell command to get the password (e.g. 'pass show powerwall')"`
+	SerialPass    bool          `long:"serial-password" description:"Use the gateway's default password (the last 5 characters of its serial number)"`
+	CertFile      string        `long:"certfile" description:"Filename of TLS certificate to use for validation"`
+	RetryTimeout  time.Duration `long:"retry-timeout" description:"How long to keep trying to reach the gateway before giving up (default: no retries)"`
+	RetryInterval time.Duration `long:"retry-interval" description:"How long to wait between retries" default:"1s"`
+	Listen        string        `long:"listen" description:"Address and port to serve metrics on" default:":9871"`
+	MetricsPath   string        `long:"metrics-path" description:"URL path to serve metrics on" default:"/metrics"`
+	PollInterval  time.Duration `long:"poll-interval" description:"Poll the gateway in the background at this interval, instead of on each scrape (default: fetch on scrape)"`
+}
+
+func logDebug(v ...interface{}) {
+	log.Debug(v...)
+}
+
+func logError(msg string, err error) {
+	log.WithFields(log.Fields{"err": err}).Error(msg)
+}
+
+// credentials returns the CredentialProvider to use, based on the command-line
+// options.  (The password itself cannot be given on the command line, since it
+// would be visible to other users in the process list.)
+func credentials() (powerwall.CredentialProvider, error) {
+	switch {
+	case options.PasswordFile != "":
+		return powerwall.NewFileCredentials(options.Email, options.PasswordFile), nil
+	case options.PasswordEnv != "":
+		creds := powerwall.NewEnvCredentials("", options.PasswordEnv)
+		creds.Email = options.Email
+		return creds, nil
+	case options.PasswordCmd != "":
+		return powerwall.NewCommandCredentials(options.Email, "sh", "-c", options.PasswordCmd), nil
+	case options.SerialPass:
+		// The client will look up the serial number itself when it
+		// logs in.
+		return powerwall.NewSerialCredentials(options.Email, ""), nil
+	default:
+		return nil, errors.New("one of --password-file, --password-env, --password-command, or --serial-password must be given")
+	}
+}
+
+func main() {
+	_, err := flags.Parse(&options)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if options.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	powerwall.SetLogFunc(logDebug)
+	powerwall.SetErrFunc(logError)
+
+	creds, err := credentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	c := powerwall.NewClientWithOptions(options.Address, powerwall.WithCredentials(creds))
+	c.SetRetry(options.RetryInterval, options.RetryTimeout)
+
+	if options.CertFile != "" {
+		pemCert, err := ioutil.ReadFile(options.CertFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read cert file: %s\n", err)
+			os.Exit(2)
+		}
+		block, _ := pem.Decode(pemCert)
+		if block == nil || block.Type != "CERTIFICATE" {
+			fmt.Fprintln(os.Stderr, "Unable to decode cert file.  Is it in PEM format?")
+			os.Exit(2)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading cert file: %s\n", err)
+			os.Exit(2)
+		}
+		err = c.TrySetTLSCert(cert)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot use cert file: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	collector := newCollector(c)
+	if options.PollInterval > 0 {
+		go collector.poll(options.PollInterval)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	http.Handle(options.MetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	log.Infof("Serving metrics on %s%s", options.Listen, options.MetricsPath)
+	err = http.ListenAndServe(options.Listen, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/foogod/go-powerwall"
+)
+
+var siteLabels = []string{"din", "site_name"}
+
+// allDescs contains every Desc created by newDesc, so that they can all be
+// reported by Describe.
+var allDescs = []*prometheus.Desc{}
+
+func newDesc(name string, help string, extraLabels ...string) *prometheus.Desc {
+	labels := append(append([]string{}, siteLabels...), extraLabels...)
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	allDescs = append(allDescs, desc)
+	return desc
+}
+
+var (
+	upDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "up"), "Whether the last collection from the gateway was successful.", nil, nil)
+
+	lastCollectionDesc = newDesc("last_collection_timestamp_seconds", "Time the data was collected from the gateway.")
+	infoDesc           = newDesc("info", "Information about the gateway.", "version", "device_type")
+	uptimeDesc         = newDesc("uptime_seconds", "How long the gateway has been running.")
+
+	soeDesc          = newDesc("soe_percent", "Total charge across all batteries (State Of Energy), as a percentage.")
+	gridStatusDesc   = newDesc("grid_status", "Current state of the connection to the utility grid (1 for the current status, 0 otherwise).", "status")
+	gridServicesDesc = newDesc("grid_services_active", "Whether grid services are currently active.")
+	gridFaultsDesc   = newDesc("grid_faults", "Number of current grid faults.")
+
+	meterInstantPowerDesc          = newDesc("meter_instant_power_watts", "Instantaneous real power.", "category")
+	meterInstantReactivePowerDesc  = newDesc("meter_instant_reactive_power_var", "Instantaneous reactive power.", "category")
+	meterInstantApparentPowerDesc  = newDesc("meter_instant_apparent_power_va", "Instantaneous apparent power.", "category")
+	meterFrequencyDesc             = newDesc("meter_frequency_hertz", "Line frequency.", "category")
+	meterEnergyExportedDesc        = newDesc("meter_energy_exported_watthours_total", "Total energy exported.", "category")
+	meterEnergyImportedDesc        = newDesc("meter_energy_imported_watthours_total", "Total energy imported.", "category")
+	meterInstantAverageVoltageDesc = newDesc("meter_instant_average_voltage_volts", "Average voltage.", "category")
+	meterInstantAverageCurrentDesc = newDesc("meter_instant_average_current_amps", "Average current.", "category")
+	meterInstantTotalCurrentDesc   = newDesc("meter_instant_total_current_amps", "Total current.", "category")
+	meterPhaseCurrentDesc          = newDesc("meter_phase_current_amps", "Current per phase.", "category", "phase")
+	meterNumMetersDesc             = newDesc("meter_num_meters_aggregated", "Number of meters aggregated.", "category")
+	meterLastCommunicationDesc     = newDesc("meter_last_communication_timestamp_seconds", "Last time the meters communicated with the gateway.", "category")
+
+	systemFullPackEnergyDesc      = newDesc("system_nominal_full_pack_energy_watthours", "Nominal energy capacity of all batteries when full.")
+	systemEnergyRemainingDesc     = newDesc("system_nominal_energy_remaining_watthours", "Nominal energy remaining in all batteries.")
+	systemMaxChargePowerDesc      = newDesc("system_max_charge_power_watts", "Maximum charge power.")
+	systemMaxDischargePowerDesc   = newDesc("system_max_discharge_power_watts", "Maximum discharge power.")
+	systemAvailableBlocksDesc     = newDesc("system_available_blocks", "Number of battery blocks available.")
+	systemBatteryTargetPowerDesc  = newDesc("system_battery_target_power_watts", "Target battery power.")
+	systemGridServicesPowerDesc   = newDesc("system_grid_services_power_watts", "Power used for grid services.")
+	systemExpectedEnergyRemaining = newDesc("system_expected_energy_remaining_watthours", "Expected energy remaining in all batteries.")
+
+	blockLabels                 = []string{"serial_number", "part_number"}
+	blockEnergyRemainingDesc    = newDesc("battery_block_nominal_energy_remaining_watthours", "Nominal energy remaining in the battery block.", blockLabels...)
+	blockFullPackEnergyDesc     = newDesc("battery_block_nominal_full_pack_energy_watthours", "Nominal energy capacity of the battery block when full.", blockLabels...)
+	blockPOutDesc               = newDesc("battery_block_p_out_watts", "Real power output of the battery block.", blockLabels...)
+	blockQOutDesc               = newDesc("battery_block_q_out_var", "Reactive power output of the battery block.", blockLabels...)
+	blockVOutDesc               = newDesc("battery_block_v_out_volts", "Output voltage of the battery block.", blockLabels...)
+	blockFOutDesc               = newDesc("battery_block_f_out_hertz", "Output frequency of the battery block.", blockLabels...)
+	blockIOutDesc               = newDesc("battery_block_i_out_amps", "Output current of the battery block.", blockLabels...)
+	blockEnergyChargedDesc      = newDesc("battery_block_energy_charged_watthours_total", "Total energy charged into the battery block.", blockLabels...)
+	blockEnergyDischargedDesc   = newDesc("battery_block_energy_discharged_watthours_total", "Total energy discharged from the battery block.", blockLabels...)
+	blockOffGridDesc            = newDesc("battery_block_off_grid", "Whether the battery block is off-grid.", blockLabels...)
+	blockBackupReadyDesc        = newDesc("battery_block_backup_ready", "Whether the battery block is ready to provide backup power.", blockLabels...)
+	blockChargePowerClampedDesc = newDesc("battery_block_charge_power_clamped", "Whether the battery block's charge power is clamped.", blockLabels...)
+)
+
+// Grid status values reported by the grid_status metric.
+var gridStatuses = []string{
+	powerwall.GridStatusConnected,
+	powerwall.GridStatusIslanded,
+	powerwall.GridStatusTransition,
+}
+
+// metrics produces metrics from a snapshot.
+type metrics struct {
+	s  *snapshot
+	ch chan<- prometheus.Metric
+}
+
+func newMetrics(s *snapshot, ch chan<- prometheus.Metric) *metrics {
+	return &metrics{s: s, ch: ch}
+}
+
+func (m *metrics) send(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labels ...string) {
+	labels = append([]string{m.s.status.Din, m.s.siteInfo.SiteName}, labels...)
+	m.ch <- prometheus.MustNewConstMetric(desc, valueType, value, labels...)
+}
+
+func (m *metrics) gauge(desc *prometheus.Desc, value float64, labels ...string) {
+	m.send(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func (m *metrics) counter(desc *prometheus.Desc, value float64, labels ...string) {
+	m.send(desc, prometheus.CounterValue, value, labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (m *metrics) collect() {
+	s := m.s
+
+	m.gauge(lastCollectionDesc, float64(s.time.UnixNano())/1e9)
+	m.gauge(infoDesc, 1, s.status.Version, s.status.DeviceType)
+	m.gauge(uptimeDesc, s.status.UpTime.Seconds())
+
+	m.gauge(soeDesc, float64(s.soe.Percentage))
+	for _, status := range gridStatuses {
+		m.gauge(gridStatusDesc, boolValue(s.gridStatus.GridStatus == status), status)
+	}
+	m.gauge(gridServicesDesc, boolValue(s.gridStatus.GridServicesActive))
+	m.gauge(gridFaultsDesc, float64(len(s.systemStatus.GridFaults)))
+
+	for category, a := range *s.aggregates {
+		m.gauge(meterInstantPowerDesc, float64(a.InstantPower), category)
+		m.gauge(meterInstantReactivePowerDesc, float64(a.InstantReactivePower), category)
+		m.gauge(meterInstantApparentPowerDesc, float64(a.InstantApparentPower), category)
+		m.gauge(meterFrequencyDesc, float64(a.Frequency), category)
+		m.counter(meterEnergyExportedDesc, float64(a.EnergyExported), category)
+		m.counter(meterEnergyImportedDesc, float64(a.EnergyImported), category)
+		m.gauge(meterInstantAverageVoltageDesc, float64(a.InstantAverageVoltage), category)
+		m.gauge(meterInstantAverageCurrentDesc, float64(a.InstantAverageCurrent), category)
+		m.gauge(meterInstantTotalCurrentDesc, float64(a.InstantTotalCurrent), category)
+		m.gauge(meterPhaseCurrentDesc, float64(a.IACurrent), category, "a")
+		m.gauge(meterPhaseCurrentDesc, float64(a.IBCurrent), category, "b")
+		m.gauge(meterPhaseCurrentDesc, float64(a.ICCurrent), category, "c")
+		m.gauge(meterNumMetersDesc, float64(a.NumMetersAggregated), category)
+		m.gauge(meterLastCommunicationDesc, float64(a.LastCommunicationTime.UnixNano())/1e9, category)
+	}
+
+	ss := s.systemStatus
+	m.gauge(systemFullPackEnergyDesc, float64(ss.NominalFullPackEnergy))
+	m.gauge(systemEnergyRemainingDesc, float64(ss.NominalEnergyRemaining))
+	m.gauge(systemMaxChargePowerDesc, float64(ss.MaxChargePower))
+	m.gauge(systemMaxDischargePowerDesc, float64(ss.MaxDischargePower))
+	m.gauge(systemAvailableBlocksDesc, float64(ss.AvailableBlocks))
+	m.gauge(systemBatteryTargetPowerDesc, float64(ss.BatteryTargetPower))
+	m.gauge(systemGridServicesPowerDesc, float64(ss.GridServicesPower))
+	m.gauge(systemExpectedEnergyRemaining, float64(ss.ExpectedEnergyRemaining))
+
+	for i, b := range ss.BatteryBlocks {
+		serial := b.PackageSerialNumber
+		if serial == "" {
+			// Shouldn't happen, but make sure we don't produce
+			// duplicate series if it does.
+			serial = strconv.Itoa(i)
+		}
+		labels := []string{serial, b.PackagePartNumber}
+		m.gauge(blockEnergyRemainingDesc, float64(b.NominalEnergyRemaining), labels...)
+		m.gauge(blockFullPackEnergyDesc, float64(b.NominalFullPackEnergy), labels...)
+		m.gauge(blockPOutDesc, float64(b.POut), labels...)
+		m.gauge(blockQOutDesc, float64(b.QOut), labels...)
+		m.gauge(blockVOutDesc, float64(b.VOut), labels...)
+		m.gauge(blockFOutDesc, float64(b.FOut), labels...)
+		m.gauge(blockIOutDesc, float64(b.IOut), labels...)
+		m.counter(blockEnergyChargedDesc, float64(b.EnergyCharged), labels...)
+		m.counter(blockEnergyDischargedDesc, float64(b.EnergyDischarged), labels...)
+		m.gauge(blockOffGridDesc, boolValue(b.OffGrid), labels...)
+		m.gauge(blockBackupReadyDesc, boolValue(b.BackupReady), labels...)
+		m.gauge(blockChargePowerClampedDesc, boolValue(b.ChargePowerClamped), labels...)
+	}
+}
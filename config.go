@@ -0,0 +1,184 @@
+// Functions for making configuration changes:
+//
+//   (*Client) WithConfigSession(fn)
+//   (*Client) WithConfigSessionContext(ctx, fn)
+//
+package powerwall
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+
+// ConfigSession is passed to the function given to WithConfigSession, and
+// provides functions for applying configuration changes while the sitemaster
+// is stopped.  Changes made through a ConfigSession are not committed until
+// the function returns successfully.
+type ConfigSession struct {
+	ctx    context.Context
+	client *Client
+}
+
+// Context returns the context which the session is running under.  This should
+// be used for any other API calls made during the session.
+func (s *ConfigSession) Context() context.Context {
+	return s.ctx
+}
+
+// Client returns the Client that the session belongs to.
+func (s *ConfigSession) Client() *Client {
+	return s.client
+}
+
+// SetOperation sends new operation mode and backup reserve settings to the
+// gateway (see (*Client).SetOperation), but does not commit them.  They will
+// be committed along with any other changes when the session completes.
+func (s *ConfigSession) SetOperation(mode string, reservePercent float32) (*OperationData, error) {
+	return s.client.postOperation(s.ctx, mode, reservePercent)
+}
+
+// PostJSON sends the provided payload (encoded as JSON) to the specified API
+// endpoint, and decodes the JSON response into result.  This can be used to
+// change settings for which there is not (yet) a dedicated function.
+func (s *ConfigSession) PostJSON(api string, payload interface{}, result interface{}) error {
+	s.client.checkLogin(s.ctx)
+	return s.client.apiPostJson(s.ctx, api, payload, result)
+}
+
+// ConfigSessionResult contains information about which steps of a
+// WithConfigSession call succeeded.  For each step, if it was attempted and
+// failed, the corresponding error field will be set.
+type ConfigSessionResult struct {
+	// StopRequested is set if a request to stop the sitemaster was sent
+	// to the gateway (whether or not it then succeeded).  If so, a
+	// restart is always attempted at the end of the session.
+	StopRequested       bool
+	SitemasterStopped   bool
+	StopErr             error
+	Applied             bool
+	ApplyErr            error
+	Committed           bool
+	CommitErr           error
+	SitemasterRestarted bool
+	RestartErr          error
+}
+
+// Err returns the first error which occurred during the session (if any).
+func (r *ConfigSessionResult) Err() error {
+	for _, err := range []error{r.StopErr, r.ApplyErr, r.CommitErr, r.RestartErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithConfigSession performs a set of configuration changes, taking care of
+// the surrounding steps which the gateway requires.  Specifically, it:
+//
+//   1. Stops the sitemaster (see StopSitemaster)
+//   2. Calls fn, which should make the desired changes using the provided
+//      ConfigSession
+//   3. Commits the changes (using the "config/completed" API)
+//   4. Restarts the sitemaster (see StartSitemaster)
+//
+// If fn returns an error, the changes are not committed.  If the sitemaster
+// was stopped (or a request to stop it was sent, even if it then failed or
+// timed out), a restart is always attempted, even if any of the other steps
+// failed.
+//
+// Waiting for the sitemaster to stop (and restart) is limited by the time set
+// with WithSitemasterTimeout.  fn itself is not subject to any time limit.
+//
+// The returned ConfigSessionResult indicates which steps were successful.  The
+// returned error is the first error encountered (the same as result.Err()).
+func (c *Client) WithConfigSession(fn func(*ConfigSession) error) (*ConfigSessionResult, error) {
+	return c.withConfigSession(context.Background(), c.sitemasterTimeout, fn)
+}
+
+// WithConfigSessionContext is the same as WithConfigSession, but uses the
+// provided context for the session.  Note that even if the context is
+// cancelled, the sitemaster restart will still be attempted (using a separate
+// context, limited by the client's sitemaster timeout), to avoid leaving the
+// system with the sitemaster down.
+func (c *Client) WithConfigSessionContext(ctx context.Context, fn func(*ConfigSession) error) (*ConfigSessionResult, error) {
+	return c.withConfigSession(ctx, 0, fn)
+}
+
+// withConfigSession does the work of WithConfigSessionContext.  If
+// stopTimeout is non-zero, stopping the sitemaster is also limited to that
+// long (in addition to being limited by ctx).
+func (c *Client) withConfigSession(ctx context.Context, stopTimeout time.Duration, fn func(*ConfigSession) error) (*ConfigSessionResult, error) {
+	result := &ConfigSessionResult{}
+
+	c.logf("Starting config session")
+	stopCtx := ctx
+	if stopTimeout > 0 {
+		var cancel context.CancelFunc
+		stopCtx, cancel = context.WithTimeout(ctx, stopTimeout)
+		defer cancel()
+	}
+	result.StopRequested, result.StopErr = c.stopSitemaster(stopCtx, false)
+	if result.StopErr != nil {
+		c.logf("Config session: could not stop sitemaster: %s", result.StopErr)
+		if result.StopRequested {
+			// The gateway may have stopped the sitemaster even
+			// though we didn't see it happen, so make sure it's
+			// running again.
+			c.restartAfterConfig(result)
+		}
+		return result, result.Err()
+	}
+	result.SitemasterStopped = true
+
+	// This is deferred so that we will still try to restart the
+	// sitemaster even if fn panics.
+	defer c.restartAfterConfig(result)
+
+	session := &ConfigSession{ctx: ctx, client: c}
+	result.ApplyErr = fn(session)
+	if result.ApplyErr != nil {
+		c.logf("Config session: applying changes failed: %s", result.ApplyErr)
+		return result, result.ApplyErr
+	}
+	result.Applied = true
+
+	result.CommitErr = c.commitConfig(ctx)
+	if result.CommitErr != nil {
+		c.logf("Config session: commit failed: %s", result.CommitErr)
+		return result, result.CommitErr
+	}
+	result.Committed = true
+
+	c.restartAfterConfig(result)
+	return result, result.Err()
+}
+
+func (c *Client) restartAfterConfig(result *ConfigSessionResult) {
+	if result.SitemasterRestarted || result.RestartErr != nil {
+		// Already done
+		return
+	}
+	// We don't want to use the caller's context here, because if it has
+	// been cancelled, we still want to try to get the sitemaster going
+	// again.
+	ctx, cancel := context.WithTimeout(context.Background(), c.sitemasterTimeout)
+	defer cancel()
+	result.RestartErr = c.StartSitemasterContext(ctx)
+	if result.RestartErr != nil {
+		c.logf("Config session: could not restart sitemaster: %s", result.RestartErr)
+	} else {
+		result.SitemasterRestarted = true
+	}
+	c.logf("Config session finished: %+v", *result)
+}
+
+// commitConfig calls the "config/completed" API, which tells the gateway to
+// apply any configuration changes which have been made.
+func (c *Client) commitConfig(ctx context.Context) error {
+	_, err := c.doHttpRequest(ctx, "config/completed", http.MethodGet, nil, "")
+	return err
+}
@@ -0,0 +1,116 @@
+package powerwall_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestConfigSession(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	result, err := client.WithConfigSession(func(session *powerwall.ConfigSession) error {
+		sm, err := session.Client().GetSitemasterContext(session.Context())
+		if err != nil {
+			return err
+		}
+		if sm.Status != powerwall.SitemasterStatusDown {
+			t.Errorf("sitemaster not stopped during session: %+v", sm)
+		}
+		_, err = session.SetOperation(powerwall.OperationModeTimeBased, 50)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.SitemasterStopped || !result.Applied || !result.Committed || !result.SitemasterRestarted {
+		t.Errorf("not all steps completed: %+v", result)
+	}
+
+	var apis []string
+	for _, r := range s.Requests() {
+		switch r.API {
+		case "sitemaster/stop", "operation", "config/completed", "sitemaster/run":
+			apis = append(apis, r.API)
+		}
+	}
+	if strings.Join(apis, ",") != "sitemaster/stop,operation,config/completed,sitemaster/run" {
+		t.Errorf("unexpected sequence of calls: %v", apis)
+	}
+}
+
+func TestConfigSessionApplyError(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	applyErr := errors.New("something went wrong")
+	result, err := client.WithConfigSession(func(session *powerwall.ConfigSession) error {
+		return applyErr
+	})
+	if err != applyErr {
+		t.Errorf("expected the apply error, got %v", err)
+	}
+	if result.Committed || !result.SitemasterRestarted {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+// stuckSitemasterTransport makes the "sitemaster" API always report that the
+// sitemaster is up, no matter what.
+type stuckSitemasterTransport struct {
+	http.RoundTripper
+}
+
+func (t stuckSitemasterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && req.URL.Path == "/api/sitemaster" {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"status": "StatusUp", "running": true, "can_reboot": "Yes"}`)),
+			Request:    req,
+		}, nil
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestConfigSessionStopTimeout(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(
+		powerwall.WithLogger(t.Log),
+		powerwall.WithTransport(stuckSitemasterTransport{s.Client().Transport}),
+		powerwall.WithSitemasterTimeout(300*time.Millisecond),
+	)
+	defer client.Close()
+
+	start := time.Now()
+	called := false
+	result, err := client.WithConfigSession(func(session *powerwall.ConfigSession) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waiting for the sitemaster to stop was not limited (took %s)", elapsed)
+	}
+	if called {
+		t.Errorf("fn was called even though the sitemaster did not stop")
+	}
+	if !result.StopRequested || !result.SitemasterRestarted {
+		t.Errorf("sitemaster was not restarted after a failed stop: %+v", result)
+	}
+}
@@ -0,0 +1,184 @@
+// Functions for supplying login credentials:
+//
+// (Note: A CredentialProvider is used by a Client if supplied with the
+// WithCredentials option)
+//
+//   NewEnvCredentials(emailVar, passwordVar)
+//   NewFileCredentials(email, path)
+//   NewCommandCredentials(email, name, args...)
+//   NewSerialCredentials(email, serial)
+//
+package powerwall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CredentialProvider is implemented by anything which can supply the email
+// address and password to use when logging into the gateway.  A Client asks
+// its CredentialProvider for the credentials every time it needs to login
+// (rather than just once when it is created), so the password can be changed
+// (for example, by updating a file or environment variable) without having to
+// create a new Client.
+type CredentialProvider interface {
+	// Credentials returns the email address and password to use.
+	Credentials(ctx context.Context) (email string, password string, err error)
+}
+
+// StaticCredentials is a CredentialProvider which always returns the same
+// email address and password.  (This is what WithLogin uses.)
+type StaticCredentials struct {
+	Email    string
+	Password string
+}
+
+// Credentials implements the CredentialProvider interface.
+func (c StaticCredentials) Credentials(ctx context.Context) (string, string, error) {
+	return c.Email, c.Password, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// EnvCredentials is a CredentialProvider which reads the email address and
+// password from environment variables.
+type EnvCredentials struct {
+	// EmailVar is the name of the variable containing the email address.
+	// If it is empty (or the variable is not set), Email is used instead.
+	EmailVar string
+	// Email is the email address to use if EmailVar is not set.
+	Email string
+	// PasswordVar is the name of the variable containing the password.
+	PasswordVar string
+}
+
+// NewEnvCredentials creates a new EnvCredentials which uses the specified
+// environment variables.
+func NewEnvCredentials(emailVar string, passwordVar string) *EnvCredentials {
+	return &EnvCredentials{EmailVar: emailVar, PasswordVar: passwordVar}
+}
+
+// Credentials implements the CredentialProvider interface.  It returns an
+// error if the password variable is not set.
+func (c *EnvCredentials) Credentials(ctx context.Context) (string, string, error) {
+	email := c.Email
+	if value, ok := os.LookupEnv(c.EmailVar); ok && c.EmailVar != "" {
+		email = value
+	}
+	password, ok := os.LookupEnv(c.PasswordVar)
+	if !ok {
+		return "", "", fmt.Errorf("environment variable %s is not set", c.PasswordVar)
+	}
+	return email, password, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// FileCredentials is a CredentialProvider which reads the password from a
+// file.  The file should contain just the password (any trailing newline is
+// ignored).  The file is read again every time the client logs in.
+type FileCredentials struct {
+	Email string
+	Path  string
+}
+
+// NewFileCredentials creates a new FileCredentials which uses the specified
+// email address, and reads the password from the specified file.
+func NewFileCredentials(email string, path string) *FileCredentials {
+	return &FileCredentials{Email: email, Path: path}
+}
+
+// Credentials implements the CredentialProvider interface.
+func (c *FileCredentials) Credentials(ctx context.Context) (string, string, error) {
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return "", "", err
+	}
+	return c.Email, strings.TrimRight(string(data), "\r\n"), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// CommandCredentials is a CredentialProvider which runs a command to obtain
+// the password.  This can be used to fetch the password from a password
+// manager or keyring (for example, "pass" or "secret-tool").  The first line
+// of the command's output is used as the password.
+type CommandCredentials struct {
+	Email string
+	// Name is the command to run.
+	Name string
+	// Args are the arguments to pass to the command.
+	Args []string
+}
+
+// NewCommandCredentials creates a new CommandCredentials which uses the
+// specified email address, and runs the specified command (with the
+// specified arguments) to get the password.  For example:
+//
+//	creds := powerwall.NewCommandCredentials("teslaguy@example.com", "pass", "show", "powerwall")
+func NewCommandCredentials(email string, name string, args ...string) *CommandCredentials {
+	return &CommandCredentials{Email: email, Name: name, Args: args}
+}
+
+// Credentials implements the CredentialProvider interface.
+func (c *CommandCredentials) Credentials(ctx context.Context) (string, string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return "", "", fmt.Errorf("command %s failed: %w (%s)", c.Name, err, msg)
+		}
+		return "", "", fmt.Errorf("command %s failed: %w", c.Name, err)
+	}
+	password := strings.SplitN(string(out), "\n", 2)[0]
+	return c.Email, strings.TrimRight(password, "\r"), nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// SerialCredentials is a CredentialProvider which uses the gateway's default
+// customer password.  Unless it has been changed, this is the last 5
+// characters of the gateway's serial number.
+//
+// (Note that some newer gateways have a different default password, which is
+// printed on a label on the gateway.  For those, use StaticCredentials or one
+// of the other providers instead.)
+type SerialCredentials struct {
+	Email string
+	// Serial is the gateway's serial number (e.g. "TG123456789ABC").  The
+	// full DIN (as returned in the Din field of GetStatus, which can be
+	// called without logging in) may also be used.  If it is empty, a
+	// Client using this provider will fetch the DIN from the gateway
+	// itself the first time it logs in.
+	Serial string
+}
+
+// NewSerialCredentials creates a new SerialCredentials which uses the
+// specified email address, and the default password for the gateway with the
+// specified serial number (or DIN).  If serial is empty, the Client will look
+// up the gateway's serial number when it logs in.
+func NewSerialCredentials(email string, serial string) *SerialCredentials {
+	return &SerialCredentials{Email: email, Serial: serial}
+}
+
+// Credentials implements the CredentialProvider interface.
+func (c *SerialCredentials) Credentials(ctx context.Context) (string, string, error) {
+	serial := strings.TrimSpace(c.Serial)
+	// A DIN is in the form "<part number>--<serial number>"
+	if i := strings.LastIndex(serial, "--"); i >= 0 {
+		serial = serial[i+2:]
+	}
+	if len(serial) < 5 {
+		return "", "", errors.New("gateway serial number is missing or too short")
+	}
+	return c.Email, serial[len(serial)-5:], nil
+}
@@ -0,0 +1,57 @@
+package powerwall_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestSerialCredentialsLookup(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	// The default "status" fixture has a DIN ending in "TG000000000000".
+	s.SetLogin(powerwalltest.DefaultEmail, "00000")
+
+	client := s.NewClient(powerwall.WithLogger(t.Log), powerwall.WithCredentials(powerwall.NewSerialCredentials(powerwalltest.DefaultEmail, "")))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.GetSOEContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging in again should not need to look up the serial number again.
+	s.ExpireTokens()
+	if _, err := client.GetSOEContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	statusCalls := 0
+	for _, r := range s.Requests() {
+		if r.API == "status" {
+			statusCalls++
+		}
+	}
+	if statusCalls != 1 {
+		t.Errorf("expected 1 status call, got %d", statusCalls)
+	}
+}
+
+func TestSerialCredentials(t *testing.T) {
+	for serial, expected := range map[string]string{
+		"TG123456789ABC":                "89ABC",
+		"1232100-00-E--TG123456789ABC":  "89ABC",
+		" 1232100-00-E--TG123456789XY ": "789XY",
+	} {
+		_, password, err := powerwall.NewSerialCredentials("", serial).Credentials(context.Background())
+		if err != nil || password != expected {
+			t.Errorf("serial %q: got %q (err=%v), expected %q", serial, password, err, expected)
+		}
+	}
+	if _, _, err := powerwall.NewSerialCredentials("", "").Credentials(context.Background()); err == nil {
+		t.Errorf("expected an error for an empty serial number")
+	}
+}
@@ -0,0 +1,132 @@
+package powerwall_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+// A "system_status/soe" response with a field of the wrong type, and one the
+// library doesn't know about.
+const badSOEResponse = `{"percentage": "lots", "new_field": 12}`
+
+// captureErrFunc registers an error function which records every error
+// reported, for the duration of the test.
+func captureErrFunc(t *testing.T) *[]error {
+	reported := &[]error{}
+	powerwall.SetErrFunc(func(msg string, err error) {
+		*reported = append(*reported, err)
+	})
+	t.Cleanup(func() { powerwall.SetErrFunc(func(string, error) {}) })
+	return reported
+}
+
+func newDecodeClient(t *testing.T, response string, options ...powerwall.Option) *powerwall.Client {
+	s := powerwalltest.NewServer()
+	t.Cleanup(s.Close)
+	s.SetFixture("system_status/soe", []byte(response))
+	client := s.NewClient(append([]powerwall.Option{powerwall.WithLogger(t.Log)}, options...)...)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestDecodeDefault(t *testing.T) {
+	reported := captureErrFunc(t)
+	client := newDecodeClient(t, badSOEResponse)
+
+	// By default, a field of the wrong type fails the call with the
+	// error from encoding/json, the same as it always has.
+	_, err := client.GetSOE()
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Field != "percentage" {
+		t.Errorf("expected a json.UnmarshalTypeError, got %#v", err)
+	}
+	if len(*reported) != 1 || (*reported)[0] != err {
+		t.Errorf("error was not reported to the error function: %v", *reported)
+	}
+
+	// Unknown fields are ignored.
+	client = newDecodeClient(t, `{"percentage": 50, "new_field": 12}`)
+	if soe, err := client.GetSOE(); err != nil || soe.Percentage != 50 {
+		t.Errorf("unexpected result %+v, %v", soe, err)
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	reported := captureErrFunc(t)
+	client := newDecodeClient(t, `{"percentage": "lots", "timestamp": 5}`, powerwall.WithDecodePolicy(powerwall.DecodeLenient))
+
+	soe, err := client.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage != 0 {
+		t.Errorf("bad field was not left as zero: %+v", soe)
+	}
+	if len(*reported) != 0 {
+		t.Errorf("errors were reported with DecodeLenient: %v", *reported)
+	}
+}
+
+func TestDecodeWarn(t *testing.T) {
+	reported := captureErrFunc(t)
+	client := newDecodeClient(t, badSOEResponse, powerwall.WithDecodePolicy(powerwall.DecodeWarn))
+
+	if _, err := client.GetSOE(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reported) != 1 {
+		t.Fatalf("expected one reported error, got %v", *reported)
+	}
+	var decodeErr powerwall.DecodeError
+	if !errors.As((*reported)[0], &decodeErr) {
+		t.Fatalf("expected a DecodeError, got %#v", (*reported)[0])
+	}
+	// Unknown fields are only included with DecodeStrict.
+	expected := []powerwall.FieldDecodeError{
+		{Path: "percentage", GoType: "float32", Value: `"lots"`},
+	}
+	if decodeErr.API != "system_status/soe" || len(decodeErr.Fields) != 1 || decodeErr.Fields[0] != expected[0] {
+		t.Errorf("unexpected DecodeError %+v", decodeErr)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	reported := captureErrFunc(t)
+	client := newDecodeClient(t, badSOEResponse, powerwall.WithDecodePolicy(powerwall.DecodeStrict))
+
+	_, err := client.GetSOE()
+	var decodeErr powerwall.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected a DecodeError, got %#v", err)
+	}
+	fields := map[string]powerwall.FieldDecodeError{}
+	for _, f := range decodeErr.Fields {
+		fields[f.Path] = f
+	}
+	if f := fields["percentage"]; f.GoType != "float32" || f.Value != `"lots"` || f.Unknown {
+		t.Errorf("unexpected details for percentage: %+v", f)
+	}
+	if f := fields["new_field"]; !f.Unknown || f.Value != "12" {
+		t.Errorf("unexpected details for new_field: %+v", f)
+	}
+	if len(decodeErr.Fields) != 2 {
+		t.Errorf("unexpected fields in DecodeError: %+v", decodeErr.Fields)
+	}
+	if len(*reported) != 1 {
+		t.Errorf("expected the error to be reported once, got %v", *reported)
+	}
+
+	// An unknown field on its own is enough to fail.
+	client = newDecodeClient(t, `{"percentage": 50, "new_field": 12}`, powerwall.WithDecodePolicy(powerwall.DecodeStrict))
+	if _, err := client.GetSOE(); !errors.As(err, &decodeErr) {
+		t.Errorf("expected a DecodeError for an unknown field, got %v", err)
+	}
+	client = newDecodeClient(t, `{"percentage": 50}`, powerwall.WithDecodePolicy(powerwall.DecodeStrict))
+	if _, err := client.GetSOE(); err != nil {
+		t.Errorf("valid response failed with DecodeStrict: %v", err)
+	}
+}
@@ -1,8 +1,14 @@
 package powerwall
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // ApiError indicates that something unexpected occurred with the HTTP API
@@ -29,3 +35,187 @@ type AuthFailure struct {
 func (e AuthFailure) Error() string {
 	return fmt.Sprintf("Authentication Failed: %s (%s)", e.ErrorText, e.Message)
 }
+
+// OperationRejected is returned by SetOperation when the gateway refuses to
+// accept the requested operation mode or backup reserve setting.  The Message
+// field contains the reason given by the gateway (if any), and Err contains
+// the underlying ApiError.
+type OperationRejected struct {
+	Mode                 string
+	BackupReservePercent float32
+	Message              string
+	Err                  ApiError
+}
+
+func newOperationRejected(mode string, reservePercent float32, apiErr ApiError) OperationRejected {
+	errInfo := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	_ = json.Unmarshal(apiErr.Body, &errInfo)
+	msg := errInfo.Message
+	if msg == "" {
+		msg = errInfo.Error
+	}
+	return OperationRejected{
+		Mode:                 mode,
+		BackupReservePercent: reservePercent,
+		Message:              msg,
+		Err:                  apiErr,
+	}
+}
+
+func (e OperationRejected) Error() string {
+	return fmt.Sprintf("Gateway rejected operation change (mode=%s backup_reserve_percent=%v): %s (status code %d)", e.Mode, e.BackupReservePercent, e.Message, e.Err.StatusCode)
+}
+
+func (e OperationRejected) Unwrap() error {
+	return e.Err
+}
+
+// SitemasterCannotStop is returned by StopSitemaster if the gateway reports
+// that it is not currently safe to stop the sitemaster (and force was not
+// specified).  The Reason field contains the reason given by the gateway (see
+// the SitemasterReboot* constants).
+type SitemasterCannotStop struct {
+	Reason string
+}
+
+func (e SitemasterCannotStop) Error() string {
+	return fmt.Sprintf("Sitemaster cannot be stopped right now: %s", e.Reason)
+}
+
+// LoginThrottled is returned when the gateway refuses a login attempt because
+// there have been too many (failed) logins recently, and the account has been
+// temporarily locked out.  RetryAfter is how long to wait before trying again
+// (based on what the gateway said, if it said anything), and Until is the time
+// at which that will be.
+//
+// Once a client has received this error, it will not attempt to login again
+// until that time, and any calls which need to login in the meantime will
+// just return a LoginThrottled error immediately (with RetryAfter updated to
+// reflect the remaining time).
+type LoginThrottled struct {
+	URL        url.URL
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+	Until      time.Time
+}
+
+func (e LoginThrottled) Error() string {
+	return fmt.Sprintf("Login throttled by gateway: %s (status code %d, retry after %s)", e.Message, e.StatusCode, e.RetryAfter.Round(time.Second))
+}
+
+// InsufficientRole is returned when calling an API which requires a role
+// (such as an installer login) which the client does not have.  Required is
+// the list of roles which would be allowed, and Roles is the list of roles the
+// client actually has (see (*Client).Roles).
+type InsufficientRole struct {
+	API      string
+	Required []string
+	Roles    []string
+}
+
+func (e InsufficientRole) Error() string {
+	return fmt.Sprintf("API '%s' requires one of the roles %v (client has %v)", e.API, e.Required, e.Roles)
+}
+
+// DecodeError is returned (or reported, depending on the client's
+// DecodePolicy) when a response from the gateway contains fields which could
+// not be decoded.  Fields contains the details for each one.
+type DecodeError struct {
+	API    string
+	Fields []FieldDecodeError
+}
+
+// FieldDecodeError describes a single field which could not be decoded.
+type FieldDecodeError struct {
+	// Path is the path to the field within the response, using JSON
+	// names (e.g. "battery_blocks[].p_out").
+	Path string
+	// GoType is the Go type the field was supposed to be decoded into
+	// (empty if Unknown is true).
+	GoType string
+	// Value is the offending JSON value (possibly truncated, if it was
+	// long).
+	Value string
+	// Unknown is true if the field is not one the library knows about
+	// (this is only reported with DecodeStrict).
+	Unknown bool
+}
+
+func (e FieldDecodeError) String() string {
+	if e.Unknown {
+		return fmt.Sprintf("unknown field %q (value %s)", e.Path, e.Value)
+	}
+	return fmt.Sprintf("field %q (%s) has invalid value %s", e.Path, e.GoType, e.Value)
+}
+
+func newDecodeError(api string, diffs []schemaDiff, includeUnknown bool) *DecodeError {
+	const maxValueLen = 100
+
+	e := DecodeError{API: api}
+	for _, d := range diffs {
+		fe := FieldDecodeError{Path: d.Field}
+		switch {
+		case d.Kind == SchemaFieldTypeChanged:
+			fe.GoType = d.goType.String()
+		case d.Kind == SchemaFieldAdded && includeUnknown:
+			fe.Unknown = true
+		default:
+			continue
+		}
+		value, _ := json.Marshal(d.value)
+		if len(value) > maxValueLen {
+			value = append(value[:maxValueLen-3], "..."...)
+		}
+		fe.Value = string(value)
+		e.Fields = append(e.Fields, fe)
+	}
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return &e
+}
+
+func (e DecodeError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.String()
+	}
+	return fmt.Sprintf("Error decoding '%s' response: %s", e.API, strings.Join(msgs, "; "))
+}
+
+// ErrUnsupportedTransport is returned by TrySetTLSCert if the client was
+// created with a custom http.RoundTripper (see WithTransport) which is not an
+// *http.Transport, and therefore cannot be configured by the library.
+var ErrUnsupportedTransport = errors.New("powerwall: operation not supported by the configured transport")
+
+// ErrClientClosed is returned by API calls made on a Client after its Close
+// function has been called (or which were still in progress at the time).
+var ErrClientClosed = errors.New("powerwall: client closed")
+
+// isTransient returns whether err is the sort of error which may go away by
+// itself if the request is tried again (network problems, the gateway being
+// busy or restarting, etc), as opposed to one which will just keep happening
+// (bad credentials, the client being closed, etc).
+func isTransient(err error) bool {
+	var netErr net.Error
+	var apiErr ApiError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, ErrClientClosed):
+		return false
+	case errors.As(err, &netErr):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &syntaxErr):
+		// Probably a truncated response
+		return true
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == 429
+	}
+	return false
+}
@@ -0,0 +1,374 @@
+// Functions for detecting events:
+//
+//   NewEventDetector(config)
+//   (*EventDetector) Process(snapshot)
+//   (*EventDetector) Run(ctx, snapshots)
+//
+package powerwall
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EventType identifies the type of an Event.
+type EventType string
+
+// Types of events which can be produced by an EventDetector:
+const (
+	// The grid has gone down (or the system has been taken off-grid),
+	// and the system is now running on battery/solar power.
+	EventGridOutageStarted EventType = "GridOutageStarted"
+	// The system has started transitioning back to the grid.
+	EventTransitionToGrid EventType = "TransitionToGrid"
+	// The system is connected to the grid again after an outage.  The
+	// event's OutageDuration field says how long the outage lasted.
+	EventGridRestored EventType = "GridRestored"
+	// The state of energy has dropped below one of the configured
+	// thresholds (the event's Threshold field says which one).
+	EventSOEBelow EventType = "SOEBelow"
+	// The state of energy has dropped to (or below) the configured backup
+	// reserve percentage.
+	EventBackupReserveReached EventType = "BackupReserveReached"
+	// A new grid fault has been reported by the gateway (see the event's
+	// GridFault field).
+	EventNewGridFault EventType = "NewGridFault"
+	// The sitemaster process has stopped.
+	EventSitemasterDown EventType = "SitemasterDown"
+	// The sitemaster process has started again after being stopped.
+	EventSitemasterUp EventType = "SitemasterUp"
+)
+
+// Event describes something noteworthy which has happened, as detected by an
+// EventDetector.  Only the fields relevant to the particular event type will
+// be set.
+type Event struct {
+	Type EventType
+	// Time is when the event occurred (as closely as we can tell, given
+	// the polling interval).
+	Time time.Time
+
+	// For grid events, the grid status which triggered the event.
+	GridStatus string
+	// For EventGridRestored, how long the outage lasted.
+	OutageDuration time.Duration
+	// For SOE-related events, the state of energy at the time of the
+	// event.
+	SOE float32
+	// For EventSOEBelow, the threshold which was crossed.  For
+	// EventBackupReserveReached, the backup reserve percentage.
+	Threshold float32
+	// For EventNewGridFault, the new fault.
+	GridFault *GridFaultData
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case EventGridRestored:
+		return fmt.Sprintf("%s at %s (outage lasted %s)", e.Type, e.Time.Format(time.RFC3339), e.OutageDuration)
+	case EventSOEBelow, EventBackupReserveReached:
+		return fmt.Sprintf("%s(%v) at %s (soe=%v)", e.Type, e.Threshold, e.Time.Format(time.RFC3339), e.SOE)
+	case EventNewGridFault:
+		return fmt.Sprintf("%s at %s (%s)", e.Type, e.Time.Format(time.RFC3339), e.GridFault.AlertName)
+	}
+	return fmt.Sprintf("%s at %s", e.Type, e.Time.Format(time.RFC3339))
+}
+
+// EventConfig contains settings for an EventDetector.
+type EventConfig struct {
+	// SOEThresholds is a list of state-of-energy percentages.  An
+	// EventSOEBelow event will be produced whenever the SOE drops below
+	// any of these values.
+	SOEThresholds []float32
+	// SOEHysteresis is how far (in percentage points) the SOE must rise
+	// back above a threshold (or the backup reserve) before another event
+	// will be produced for it.  This prevents a flood of events when the
+	// SOE is hovering right around the threshold.
+	SOEHysteresis float32
+	// GridDebounce is how long a new grid status must persist before it
+	// is considered real and an event is produced.  This avoids events
+	// for momentary glitches.  Zero means events are produced
+	// immediately.
+	GridDebounce time.Duration
+}
+
+// DefaultEventConfig contains reasonable defaults for an EventConfig.
+var DefaultEventConfig = EventConfig{
+	SOEThresholds: []float32{50, 20},
+	SOEHysteresis: 2,
+	GridDebounce:  5 * time.Second,
+}
+
+// EventDetector watches a series of Snapshots (usually from a Watcher) and
+// produces Events when it sees certain changes in the system state.  It is
+// intended to save applications from all needing to implement their own state
+// tracking for common situations such as grid outages, low battery, etc.
+//
+// Which events can be produced depends on which endpoints are included in the
+// snapshots:
+//
+//   WatchGridStatus:   EventGridOutageStarted, EventTransitionToGrid, EventGridRestored
+//   WatchSOE:          EventSOEBelow
+//   WatchSOE + WatchOperation: EventBackupReserveReached
+//   WatchGridFaults or WatchSystemStatus: EventNewGridFault
+//   WatchSitemaster:   EventSitemasterDown, EventSitemasterUp
+//
+// Note that events are only produced for changes.  The first snapshot
+// processed is used to establish the initial state, and does not produce
+// events (so, for example, starting up during an outage will not produce
+// EventGridOutageStarted, and grid faults which were already present will not
+// produce EventNewGridFault).  Likewise, EventBackupReserveReached is only
+// produced once both the SOE and the backup reserve are known.
+type EventDetector struct {
+	config EventConfig
+
+	// Grid state
+	gridUpdated   time.Time
+	gridState     string
+	gridCandidate string
+	gridCandSince time.Time
+	outageStart   time.Time
+	// SOE state
+	soeUpdated     time.Time
+	soeInitialized bool
+	soeArmed       map[float32]bool
+	// Backup reserve state
+	reserveInitialized bool
+	reserveArmed       bool
+	// Grid fault state
+	faultsUpdated     time.Time
+	faultsInitialized bool
+	seenFaults        map[string]bool
+	// Sitemaster state
+	sitemasterUpdated time.Time
+	sitemasterState   string
+}
+
+// NewEventDetector creates a new EventDetector using the provided config.
+func NewEventDetector(config EventConfig) *EventDetector {
+	return &EventDetector{
+		config:     config,
+		soeArmed:   map[float32]bool{},
+		seenFaults: map[string]bool{},
+	}
+}
+
+// Process examines a new snapshot, and returns any events which have occurred
+// since the previous one.  Snapshots should be provided in the order they
+// were produced.
+func (d *EventDetector) Process(s Snapshot) []Event {
+	events := []Event{}
+	events = append(events, d.processGrid(s)...)
+	events = append(events, d.processSOE(s)...)
+	events = append(events, d.processFaults(s)...)
+	events = append(events, d.processSitemaster(s)...)
+	return events
+}
+
+// Run processes snapshots from the provided channel until it is closed or ctx
+// is cancelled, and sends any resulting events to the returned channel (which
+// is closed when Run finishes).
+func (d *EventDetector) Run(ctx context.Context, snapshots <-chan Snapshot) <-chan Event {
+	event_ch := make(chan Event, 10)
+	go func() {
+		defer close(event_ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s, ok := <-snapshots:
+				if !ok {
+					return
+				}
+				for _, e := range d.Process(s) {
+					select {
+					case event_ch <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return event_ch
+}
+
+// fresh returns the time the endpoint was updated in the snapshot, and
+// whether that is newer than the last time we looked at it.
+func fresh(s Snapshot, endpoint WatchEndpoint, last time.Time) (time.Time, bool) {
+	t, ok := s.Updated[endpoint]
+	return t, ok && t.After(last)
+}
+
+func (d *EventDetector) processGrid(s Snapshot) []Event {
+	t, ok := fresh(s, WatchGridStatus, d.gridUpdated)
+	if !ok || s.GridStatus == nil {
+		return nil
+	}
+	d.gridUpdated = t
+	status := s.GridStatus.GridStatus
+
+	if d.gridState == "" {
+		// First observation
+		d.gridState = status
+		d.gridCandidate = status
+		if status != GridStatusConnected {
+			// We don't know when it actually started, but this
+			// is the best guess we have.
+			d.outageStart = t
+		}
+		return nil
+	}
+
+	if status != d.gridCandidate {
+		d.gridCandidate = status
+		d.gridCandSince = t
+	}
+	if d.gridCandidate == d.gridState || t.Sub(d.gridCandSince) < d.config.GridDebounce {
+		return nil
+	}
+
+	// The new status has persisted long enough.  Make it official.
+	prev := d.gridState
+	d.gridState = d.gridCandidate
+	eventTime := d.gridCandSince
+	events := []Event{}
+	switch d.gridState {
+	case GridStatusIslanded:
+		if prev == GridStatusConnected {
+			d.outageStart = eventTime
+			events = append(events, Event{Type: EventGridOutageStarted, Time: eventTime, GridStatus: d.gridState})
+		}
+	case GridStatusTransition:
+		if prev == GridStatusConnected {
+			// Apparently we missed the outage starting, somehow.
+			d.outageStart = eventTime
+			events = append(events, Event{Type: EventGridOutageStarted, Time: eventTime, GridStatus: d.gridState})
+		}
+		events = append(events, Event{Type: EventTransitionToGrid, Time: eventTime, GridStatus: d.gridState})
+	case GridStatusConnected:
+		events = append(events, Event{
+			Type:           EventGridRestored,
+			Time:           eventTime,
+			GridStatus:     d.gridState,
+			OutageDuration: eventTime.Sub(d.outageStart),
+		})
+	}
+	return events
+}
+
+func (d *EventDetector) processSOE(s Snapshot) []Event {
+	t, ok := fresh(s, WatchSOE, d.soeUpdated)
+	if !ok || s.SOE == nil {
+		return nil
+	}
+	d.soeUpdated = t
+	soe := s.SOE.Percentage
+	hyst := d.config.SOEHysteresis
+
+	events := []Event{}
+	first := !d.soeInitialized
+	d.soeInitialized = true
+
+	thresholds := append([]float32{}, d.config.SOEThresholds...)
+	// Report the higher thresholds first, if we cross more than one at
+	// once.
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] > thresholds[j] })
+	for _, threshold := range thresholds {
+		armed, seen := d.soeArmed[threshold]
+		if first || !seen {
+			d.soeArmed[threshold] = soe >= threshold
+			continue
+		}
+		if armed && soe < threshold {
+			d.soeArmed[threshold] = false
+			events = append(events, Event{Type: EventSOEBelow, Time: t, SOE: soe, Threshold: threshold})
+		} else if !armed && soe >= threshold+hyst {
+			d.soeArmed[threshold] = true
+		}
+	}
+
+	if s.Operation != nil {
+		reserve := s.Operation.BackupReservePercent
+		if !d.reserveInitialized {
+			// This is the first time we've known both the SOE and
+			// the reserve (which may not be the first SOE, if the
+			// operation endpoint hadn't been fetched yet).
+			d.reserveInitialized = true
+			d.reserveArmed = soe > reserve
+		} else if d.reserveArmed && soe <= reserve {
+			d.reserveArmed = false
+			events = append(events, Event{Type: EventBackupReserveReached, Time: t, SOE: soe, Threshold: reserve})
+		} else if !d.reserveArmed && soe > reserve+hyst {
+			d.reserveArmed = true
+		}
+	}
+	return events
+}
+
+func gridFaultKey(f *GridFaultData) string {
+	return fmt.Sprintf("%d/%s/%s/%d", f.Timestamp, f.AlertName, f.EcuPackageSerialNumber, f.AlertRaw)
+}
+
+func (d *EventDetector) processFaults(s Snapshot) []Event {
+	var faults []GridFaultData
+	var t time.Time
+	var ok bool
+	if s.GridFaults != nil {
+		faults = *s.GridFaults
+		t, ok = fresh(s, WatchGridFaults, d.faultsUpdated)
+	} else if s.SystemStatus != nil {
+		faults = s.SystemStatus.GridFaults
+		t, ok = fresh(s, WatchSystemStatus, d.faultsUpdated)
+	}
+	if !ok {
+		return nil
+	}
+	d.faultsUpdated = t
+
+	events := []Event{}
+	first := !d.faultsInitialized
+	d.faultsInitialized = true
+	// We only need to remember the faults which are currently being
+	// reported (anything else has already gone from the gateway's list,
+	// and won't come back with the same key), so the set is rebuilt each
+	// time rather than growing forever.
+	current := make(map[string]bool, len(faults))
+	for i := range faults {
+		key := gridFaultKey(&faults[i])
+		if current[key] {
+			continue
+		}
+		current[key] = true
+		if first || d.seenFaults[key] {
+			continue
+		}
+		fault := faults[i]
+		events = append(events, Event{Type: EventNewGridFault, Time: t, GridFault: &fault})
+	}
+	d.seenFaults = current
+	return events
+}
+
+func (d *EventDetector) processSitemaster(s Snapshot) []Event {
+	t, ok := fresh(s, WatchSitemaster, d.sitemasterUpdated)
+	if !ok || s.Sitemaster == nil {
+		return nil
+	}
+	d.sitemasterUpdated = t
+	status := s.Sitemaster.Status
+	prev := d.sitemasterState
+	d.sitemasterState = status
+	if prev == "" || prev == status {
+		return nil
+	}
+	switch status {
+	case SitemasterStatusDown:
+		return []Event{{Type: EventSitemasterDown, Time: t}}
+	case SitemasterStatusUp:
+		return []Event{{Type: EventSitemasterUp, Time: t}}
+	}
+	return nil
+}
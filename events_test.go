@@ -0,0 +1,159 @@
+package powerwall_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+var eventEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// snapshot builds a Snapshot in which all of the provided endpoints were
+// updated at the given number of seconds after eventEpoch.
+func snapshot(seconds int, endpoints ...powerwall.WatchEndpoint) powerwall.Snapshot {
+	t := eventEpoch.Add(time.Duration(seconds) * time.Second)
+	s := powerwall.Snapshot{Time: t, Updated: map[powerwall.WatchEndpoint]time.Time{}}
+	for _, endpoint := range endpoints {
+		s.Updated[endpoint] = t
+	}
+	return s
+}
+
+func soeSnapshot(seconds int, soe float32, op *powerwall.OperationData) powerwall.Snapshot {
+	s := snapshot(seconds, powerwall.WatchSOE)
+	s.SOE = &powerwall.SOEData{Percentage: soe}
+	if op != nil {
+		s.Operation = op
+		s.Updated[powerwall.WatchOperation] = s.Time
+	}
+	return s
+}
+
+func eventTypes(events []powerwall.Event) []powerwall.EventType {
+	result := []powerwall.EventType{}
+	for _, e := range events {
+		result = append(result, e.Type)
+	}
+	return result
+}
+
+func TestEventGrid(t *testing.T) {
+	d := powerwall.NewEventDetector(powerwall.EventConfig{GridDebounce: 5 * time.Second})
+	grid := func(seconds int, status string) []powerwall.EventType {
+		s := snapshot(seconds, powerwall.WatchGridStatus)
+		s.GridStatus = &powerwall.GridStatusData{GridStatus: status}
+		return eventTypes(d.Process(s))
+	}
+
+	steps := []struct {
+		seconds  int
+		status   string
+		expected []powerwall.EventType
+	}{
+		{0, powerwall.GridStatusConnected, nil},
+		// A momentary glitch is debounced.
+		{10, powerwall.GridStatusIslanded, nil},
+		{12, powerwall.GridStatusConnected, nil},
+		{20, powerwall.GridStatusIslanded, nil},
+		{30, powerwall.GridStatusIslanded, []powerwall.EventType{powerwall.EventGridOutageStarted}},
+		{100, powerwall.GridStatusConnected, nil},
+		{110, powerwall.GridStatusConnected, []powerwall.EventType{powerwall.EventGridRestored}},
+	}
+	for _, step := range steps {
+		got := grid(step.seconds, step.status)
+		if len(got) != len(step.expected) || (len(got) > 0 && got[0] != step.expected[0]) {
+			t.Errorf("at %ds (%s): expected %v, got %v", step.seconds, step.status, step.expected, got)
+		}
+	}
+}
+
+func TestEventSOEThresholds(t *testing.T) {
+	d := powerwall.NewEventDetector(powerwall.EventConfig{SOEThresholds: []float32{20, 50}, SOEHysteresis: 2})
+	steps := []struct {
+		soe      float32
+		expected int
+	}{
+		{60, 0},
+		{49, 1}, // below 50
+		{51, 0}, // not far enough above 50 to re-arm
+		{49, 0},
+		{53, 0}, // re-armed
+		{10, 2}, // below 50 and 20 at once
+	}
+	for i, step := range steps {
+		events := d.Process(soeSnapshot(i, step.soe, nil))
+		if len(events) != step.expected {
+			t.Errorf("soe %v: expected %d events, got %v", step.soe, step.expected, events)
+		}
+	}
+}
+
+func TestEventBackupReserve(t *testing.T) {
+	op := &powerwall.OperationData{BackupReservePercent: 20}
+
+	// The reserve is not known until after the first SOE.  It should not
+	// be armed until both are known.
+	d := powerwall.NewEventDetector(powerwall.EventConfig{SOEHysteresis: 2})
+	for i, step := range []struct {
+		soe      float32
+		op       *powerwall.OperationData
+		expected []powerwall.EventType
+	}{
+		{50, nil, nil},
+		{40, op, nil},
+		{19, op, []powerwall.EventType{powerwall.EventBackupReserveReached}},
+		{18, op, nil},
+	} {
+		got := eventTypes(d.Process(soeSnapshot(i, step.soe, step.op)))
+		if len(got) != len(step.expected) {
+			t.Errorf("step %d (soe %v): expected %v, got %v", i, step.soe, step.expected, got)
+		}
+	}
+
+	// If we're already below the reserve when we first know both, that
+	// is not an event.
+	d = powerwall.NewEventDetector(powerwall.EventConfig{SOEHysteresis: 2})
+	d.Process(soeSnapshot(0, 50, nil))
+	if events := d.Process(soeSnapshot(1, 15, op)); len(events) != 0 {
+		t.Errorf("unexpected events when first learning the reserve: %v", events)
+	}
+	if events := d.Process(soeSnapshot(2, 10, op)); len(events) != 0 {
+		t.Errorf("unexpected events while below the reserve: %v", events)
+	}
+}
+
+func TestEventGridFaults(t *testing.T) {
+	d := powerwall.NewEventDetector(powerwall.EventConfig{})
+	faultA := powerwall.GridFaultData{Timestamp: 1000, AlertName: "PINV_a008_vfCheckUnderFrequency"}
+	faultB := powerwall.GridFaultData{Timestamp: 2000, AlertName: "PINV_a006_vfCheckUnderVoltage"}
+	faults := func(seconds int, list ...powerwall.GridFaultData) []powerwall.Event {
+		s := snapshot(seconds, powerwall.WatchGridFaults)
+		s.GridFaults = &list
+		return d.Process(s)
+	}
+
+	if events := faults(0, faultA); len(events) != 0 {
+		t.Errorf("faults already present produced events: %v", events)
+	}
+	events := faults(1, faultA, faultB, faultB)
+	if len(events) != 1 || events[0].GridFault.AlertName != faultB.AlertName {
+		t.Errorf("expected one event for the new fault, got %v", events)
+	}
+	if events := faults(2, faultB); len(events) != 0 {
+		t.Errorf("unexpected events when a fault went away: %v", events)
+	}
+	// A snapshot produced by some other endpoint, with the same (not
+	// updated) faults, should not be looked at again.
+	s := snapshot(3, powerwall.WatchSOE)
+	s.Updated[powerwall.WatchGridFaults] = eventEpoch.Add(2 * time.Second)
+	s.GridFaults = &[]powerwall.GridFaultData{faultA}
+	if events := d.Process(s); len(events) != 0 {
+		t.Errorf("stale faults produced events: %v", events)
+	}
+	// Only the currently-reported faults are remembered, so one which
+	// went away and is reported again counts as new.
+	if events := faults(4, faultA, faultB); len(events) != 1 || events[0].GridFault.AlertName != faultA.AlertName {
+		t.Errorf("expected one event for the re-reported fault, got %v", events)
+	}
+}
@@ -0,0 +1,135 @@
+package export
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// Measurement names used for each type of data:
+const (
+	MeasurementMeterAggregates = "meters_aggregates"
+	MeasurementSystemStatus    = "system_status"
+	MeasurementBatteryBlock    = "battery_block"
+	MeasurementSOE             = "soe"
+	MeasurementGridStatus      = "grid_status"
+)
+
+// structFields returns the simple (numeric, bool, and string) fields of a
+// struct, keyed by their JSON names.  Other fields (nested structs, slices,
+// times, etc) are skipped.
+func structFields(v interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fv := rv.Field(i)
+		switch fv.Kind() {
+		case reflect.Float32:
+			result[name] = float32(fv.Float())
+		case reflect.Float64:
+			result[name] = fv.Float()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			result[name] = fv.Int()
+		case reflect.Bool:
+			result[name] = fv.Bool()
+		case reflect.String:
+			result[name] = fv.String()
+		}
+	}
+	return result
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result
+}
+
+// MeterAggregates converts the result of GetMetersAggregates into points (one
+// per category, with the category name in the "category" tag).  The provided
+// tags (if any) are added to every point.
+func MeterAggregates(data map[string]powerwall.MeterAggregatesData, t time.Time, tags map[string]string) []Point {
+	points := make([]Point, 0, len(data))
+	for category, agg := range data {
+		pointTags := copyTags(tags)
+		pointTags["category"] = category
+		points = append(points, Point{
+			Measurement: MeasurementMeterAggregates,
+			Tags:        pointTags,
+			Fields:      structFields(&agg),
+			Time:        t,
+		})
+	}
+	return points
+}
+
+// SystemStatus converts the result of GetSystemStatus into points.  This
+// produces one "system_status" point containing the overall status (including
+// a "grid_faults" field containing the number of current grid faults), plus
+// one "battery_block" point for each battery block (tagged with the block's
+// "PackagePartNumber" and "PackageSerialNumber").  The provided tags (if any)
+// are added to every point.
+func SystemStatus(data *powerwall.SystemStatusData, t time.Time, tags map[string]string) []Point {
+	fields := structFields(data)
+	fields["grid_faults"] = len(data.GridFaults)
+	points := []Point{{
+		Measurement: MeasurementSystemStatus,
+		Tags:        copyTags(tags),
+		Fields:      fields,
+		Time:        t,
+	}}
+	for i := range data.BatteryBlocks {
+		blockFields := structFields(&data.BatteryBlocks[i])
+		blockTags := copyTags(tags)
+		for _, tag := range []string{"Type", "PackagePartNumber", "PackageSerialNumber"} {
+			// These are more useful as tags than fields
+			if v, ok := blockFields[tag].(string); ok {
+				blockTags[tag] = v
+				delete(blockFields, tag)
+			}
+		}
+		points = append(points, Point{
+			Measurement: MeasurementBatteryBlock,
+			Tags:        blockTags,
+			Fields:      blockFields,
+			Time:        t,
+		})
+	}
+	return points
+}
+
+// SOE converts the result of GetSOE into a point.  The provided tags (if any)
+// are added to the point.
+func SOE(data *powerwall.SOEData, t time.Time, tags map[string]string) []Point {
+	return []Point{{
+		Measurement: MeasurementSOE,
+		Tags:        copyTags(tags),
+		Fields:      structFields(data),
+		Time:        t,
+	}}
+}
+
+// GridStatus converts the result of GetGridStatus into a point.  The provided
+// tags (if any) are added to the point.
+func GridStatus(data *powerwall.GridStatusData, t time.Time, tags map[string]string) []Point {
+	return []Point{{
+		Measurement: MeasurementGridStatus,
+		Tags:        copyTags(tags),
+		Fields:      structFields(data),
+		Time:        t,
+	}}
+}
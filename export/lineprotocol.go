@@ -0,0 +1,118 @@
+// Package export converts data returned by the powerwall library into InfluxDB
+// line protocol, and provides writers for sending it to an InfluxDB-compatible
+// HTTP endpoint, or storing it in local files.
+//
+// Measurement, tag and field names are taken from the JSON names of the
+// corresponding fields in the powerwall data types (e.g. "instant_power",
+// "nominal_energy_remaining", etc), so they will be the same as the names used
+// by the gateway's own API.
+package export
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a single InfluxDB data point.
+//
+// Field values may be any of float32, float64, int, int64, bool, or string.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	// Line protocol has no way to include a newline in a string field
+	// (it would end the line), so they are replaced with "\n", the same
+	// as in tags.
+	stringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// LineProtocol returns the point encoded as a single line of InfluxDB line
+// protocol (without a trailing newline).  Tags and fields are sorted by name.
+// Timestamps are in nanoseconds.
+func (p Point) LineProtocol() string {
+	var b strings.Builder
+
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+
+	tagNames := make([]string, 0, len(p.Tags))
+	for name := range p.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+	for _, name := range tagNames {
+		value := p.Tags[name]
+		if value == "" {
+			// Empty tag values are not allowed
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(keyEscaper.Replace(name))
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(value))
+	}
+
+	fieldNames := make([]string, 0, len(p.Fields))
+	for name := range p.Fields {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+	sep := byte(' ')
+	for _, name := range fieldNames {
+		value, ok := formatFieldValue(p.Fields[name])
+		if !ok {
+			continue
+		}
+		b.WriteByte(sep)
+		sep = ','
+		b.WriteString(keyEscaper.Replace(name))
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+
+	if !p.Time.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(p.Time.UnixNano(), 10))
+	}
+	return b.String()
+}
+
+func formatFieldValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(x) + "i", true
+	case int64:
+		return strconv.FormatInt(x, 10) + "i", true
+	case bool:
+		return strconv.FormatBool(x), true
+	case string:
+		return `"` + stringEscaper.Replace(x) + `"`, true
+	}
+	return "", false
+}
+
+// Encode encodes a list of points into line protocol, one line per point.
+// Points which have no fields are skipped (they are not valid in line
+// protocol).
+func Encode(points []Point) []byte {
+	var b strings.Builder
+	for _, p := range points {
+		if len(p.Fields) == 0 {
+			continue
+		}
+		b.WriteString(p.LineProtocol())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
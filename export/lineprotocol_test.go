@@ -0,0 +1,98 @@
+package export
+
+import (
+	"testing"
+	"time"
+)
+
+var lineProtocolEpoch = time.Unix(1656806400, 123456789)
+
+func TestLineProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		point    Point
+		expected string
+	}{
+		{
+			name: "basic",
+			point: Point{
+				Measurement: "soe",
+				Tags:        map[string]string{"site": "home"},
+				Fields:      map[string]interface{}{"percentage": float32(42.5)},
+				Time:        lineProtocolEpoch,
+			},
+			expected: `soe,site=home percentage=42.5 1656806400123456789`,
+		},
+		{
+			name: "field types, sorted",
+			point: Point{
+				Measurement: "m",
+				Fields: map[string]interface{}{
+					"f64":    1.25,
+					"f32":    float32(0.1),
+					"int":    3,
+					"int64":  int64(-4),
+					"bool":   true,
+					"string": "text",
+					"other":  []int{1},
+				},
+			},
+			expected: `m bool=true,f32=0.1,f64=1.25,int=3i,int64=-4i,string="text"`,
+		},
+		{
+			name: "measurement escaping",
+			point: Point{
+				Measurement: "my measurement,with=stuff",
+				Fields:      map[string]interface{}{"value": 1},
+			},
+			expected: `my\ measurement\,with=stuff value=1i`,
+		},
+		{
+			name: "tag escaping",
+			point: Point{
+				Measurement: "m",
+				Tags: map[string]string{
+					"tag key":  "a value, with=things",
+					"b=tag":    "line\nbreak",
+					"empty":    "",
+					"c,tag":    `back\slash`,
+					"d\"quote": `"quoted"`,
+				},
+				Fields: map[string]interface{}{"value": 1},
+			},
+			expected: `m,b\=tag=line\nbreak,c\,tag=back\slash,d"quote="quoted",tag\ key=a\ value\,\ with\=things value=1i`,
+		},
+		{
+			name: "field escaping",
+			point: Point{
+				Measurement: "m",
+				Fields: map[string]interface{}{
+					"field key":  `say "hi" \ bye`,
+					"a,b=c":      "plain",
+					"multi line": "one\ntwo",
+				},
+			},
+			expected: `m a\,b\=c="plain",field\ key="say \"hi\" \\ bye",multi\ line="one\ntwo"`,
+		},
+	}
+	for _, test := range tests {
+		if got := test.point.LineProtocol(); got != test.expected {
+			t.Errorf("%s:\n got: %s\nwant: %s", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	points := []Point{
+		{Measurement: "a", Fields: map[string]interface{}{"x": 1}, Time: lineProtocolEpoch},
+		{Measurement: "empty", Tags: map[string]string{"t": "v"}},
+		{Measurement: "b", Fields: map[string]interface{}{"y": "z"}},
+	}
+	expected := "a x=1i 1656806400123456789\nb y=\"z\"\n"
+	if got := string(Encode(points)); got != expected {
+		t.Errorf("got %q, want %q", got, expected)
+	}
+	if got := Encode(nil); len(got) != 0 {
+		t.Errorf("expected nothing for no points, got %q", got)
+	}
+}
@@ -0,0 +1,211 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Writer is implemented by anything which can store a set of points.
+type Writer interface {
+	Write(ctx context.Context, points []Point) error
+	Close() error
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// HTTPWriter sends points to an InfluxDB-compatible HTTP write endpoint.
+type HTTPWriter struct {
+	// URL is the full URL of the write endpoint, including any query
+	// parameters (for example
+	// "http://localhost:8086/api/v2/write?org=home&bucket=powerwall" or
+	// "http://localhost:8086/write?db=powerwall").
+	URL string
+	// Token is the API token to send in the Authorization header (if
+	// empty, no Authorization header is sent).
+	Token string
+	// Client is the HTTP client to use.
+	Client *http.Client
+}
+
+// NewHTTPWriter creates a new HTTPWriter which will send points to the
+// specified URL, using the provided token (which may be empty) for
+// authorization.
+func NewHTTPWriter(url string, token string) *HTTPWriter {
+	return &HTTPWriter{
+		URL:    url,
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Write sends the points to the server.
+func (w *HTTPWriter) Write(ctx context.Context, points []Point) error {
+	body := Encode(points)
+	if len(body) == 0 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.Token)
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("write to %s returned unexpected status code %d (%#v)", w.URL, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// Close does nothing for an HTTPWriter.
+func (w *HTTPWriter) Close() error {
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// FileWriter appends points to a local file.  When the file grows beyond a
+// given size, it is rotated: the current file is renamed with a ".1" suffix
+// (and any existing ".1" file becomes ".2", and so on), and a new file is
+// started.
+//
+// If rotating the file fails (for example, because of a permissions problem
+// with the directory), points continue to be appended to the current file, and
+// rotation is attempted again on the next write.  Each Write call which
+// experiences a rotation failure returns an error (even though the points
+// were still written).
+type FileWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+// NewFileWriter creates a new FileWriter which will append points to the file
+// at path.  When the file would exceed maxSize bytes, it is rotated, keeping
+// at most maxFiles old files.  If maxSize is zero (or negative), the file is
+// never rotated.
+func NewFileWriter(path string, maxSize int64, maxFiles int) (*FileWriter, error) {
+	w := &FileWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *FileWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file out of the way and opens a new one.  If that
+// fails, whichever file is now at w.path (the old one, if it could not be
+// moved) is reopened, so that writing can continue.
+func (w *FileWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = w.shift()
+	}
+	openErr := w.open()
+	if err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// shift renames the existing files to make room for a new one.
+func (w *FileWriter) shift() error {
+	var err error
+	if w.maxFiles > 0 {
+		// Remove the oldest (if present), then shift everything else up.
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		err = os.Rename(w.path, w.path+".1")
+	} else {
+		err = os.Remove(w.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Write appends the points to the file.
+func (w *FileWriter) Write(ctx context.Context, points []Point) error {
+	data := Encode(points)
+	if len(data) == 0 {
+		return nil
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if w.file != nil && w.maxSize > 0 && w.size > 0 && w.size+int64(len(data)) > w.maxSize {
+		rotateErr = w.rotate()
+	}
+	if w.file == nil {
+		// A previous rotation failed to reopen the file.  Try again.
+		if err := w.open(); err != nil {
+			if rotateErr != nil {
+				return fmt.Errorf("unable to rotate %s: %w", w.path, rotateErr)
+			}
+			return err
+		}
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("unable to rotate %s (points were still written): %w", w.path, rotateErr)
+	}
+	return err
+}
+
+// Close closes the file.
+func (w *FileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
@@ -0,0 +1,131 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPoints returns a single point, which encodes to a 10-byte line.
+func testPoints(value int) []Point {
+	return []Point{{Measurement: "m", Fields: map[string]interface{}{"v": value}}}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileWriterRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.lp")
+	w, err := NewFileWriter(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 106; i++ {
+		if err := w.Write(context.Background(), testPoints(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for suffix, expected := range map[string]string{
+		"":   "m v=104i\nm v=105i\n",
+		".1": "m v=102i\nm v=103i\n",
+		".2": "m v=100i\nm v=101i\n",
+	} {
+		if got := readFile(t, path+suffix); got != expected {
+			t.Errorf("%s: got %q, want %q", path+suffix, got, expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than maxFiles old files were kept")
+	}
+
+	if err := w.Write(context.Background(), testPoints(1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestFileWriterRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "points.lp")
+	w, err := NewFileWriter(path, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// Put something in the way of the rotated file, so rotation will
+	// fail.
+	blocker := path + ".1"
+	if err := os.MkdirAll(filepath.Join(blocker, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 102; i++ {
+		if err := w.Write(context.Background(), testPoints(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every write which needs to rotate should report the failure, but
+	// the points should still be written.
+	for i := 102; i < 104; i++ {
+		err := w.Write(context.Background(), testPoints(i))
+		if err == nil || !strings.Contains(err.Error(), "rotate") {
+			t.Errorf("write %d: expected a rotation error, got %v", i, err)
+		}
+	}
+	if got := readFile(t, path); got != "m v=100i\nm v=101i\nm v=102i\nm v=103i\n" {
+		t.Errorf("unexpected file contents after failed rotation: %q", got)
+	}
+
+	// Once the problem is fixed, rotation should work again.
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(context.Background(), testPoints(104)); err != nil {
+		t.Errorf("write after fixing rotation failed: %v", err)
+	}
+	if got := readFile(t, path); got != "m v=104i\n" {
+		t.Errorf("unexpected file contents after rotation: %q", got)
+	}
+	if got := readFile(t, blocker); !strings.HasPrefix(got, "m v=100i\n") {
+		t.Errorf("old file not rotated: %q", got)
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	var body, auth string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	w := NewHTTPWriter(server.URL+"/api/v2/write?bucket=test", "secret")
+	if err := w.Write(context.Background(), testPoints(1)); err != nil {
+		t.Fatal(err)
+	}
+	if body != "m v=1i\n" || auth != "Token secret" {
+		t.Errorf("unexpected request: body=%q auth=%q", body, auth)
+	}
+
+	status = http.StatusUnauthorized
+	if err := w.Write(context.Background(), testPoints(1)); err == nil {
+		t.Errorf("expected an error for a 401 response")
+	}
+}
@@ -0,0 +1,29 @@
+package powerwall
+
+import "context"
+
+// Gateway is the set of functions common to all of the ways this library can
+// access a Powerwall system.  Code which only needs these functions can accept
+// a Gateway instead of a concrete type, which allows it to work with either a
+// local connection (Client) or Tesla's servers (CloudClient), or a test fake,
+// etc.
+type Gateway interface {
+	GetStatus() (*StatusData, error)
+	GetStatusContext(ctx context.Context) (*StatusData, error)
+	GetSOE() (*SOEData, error)
+	GetSOEContext(ctx context.Context) (*SOEData, error)
+	GetMetersAggregates() (*map[string]MeterAggregatesData, error)
+	GetMetersAggregatesContext(ctx context.Context) (*map[string]MeterAggregatesData, error)
+	GetGridStatus() (*GridStatusData, error)
+	GetGridStatusContext(ctx context.Context) (*GridStatusData, error)
+	GetOperation() (*OperationData, error)
+	GetOperationContext(ctx context.Context) (*OperationData, error)
+	SetOperation(mode string, reservePercent float32) (*OperationData, error)
+	SetOperationContext(ctx context.Context, mode string, reservePercent float32) (*OperationData, error)
+}
+
+// Make sure our implementations actually implement the interface.
+var (
+	_ Gateway = (*Client)(nil)
+	_ Gateway = (*CloudClient)(nil)
+)
@@ -1,11 +1,14 @@
 // Functions for reading power meter data:
 //
 //   (*Client) GetMeters(category string)
+//   (*Client) GetMetersContext(ctx, category string)
 //   (*Client) GetMetersAggregates()
+//   (*Client) GetMetersAggregatesContext(ctx)
 //
 package powerwall
 
 import (
+	"context"
 	"net/url"
 	"time"
 )
@@ -35,6 +38,8 @@ type MeterAggregatesData struct {
 	Timeout                           int       `json:"timeout"`
 	NumMetersAggregated               int       `json:"num_meters_aggregated"`
 	InstantTotalCurrent               float32   `json:"instant_total_current"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetMetersAggregates fetches aggregated meter data for power transferred
@@ -42,9 +47,15 @@ type MeterAggregatesData struct {
 //
 // See the MetersAggregatesData type for more information on what fields this returns.
 func (c *Client) GetMetersAggregates() (*map[string]MeterAggregatesData, error) {
-	c.checkLogin()
+	return c.GetMetersAggregatesContext(context.Background())
+}
+
+// GetMetersAggregatesContext is the same as GetMetersAggregates, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetMetersAggregatesContext(ctx context.Context) (*map[string]MeterAggregatesData, error) {
+	c.checkLogin(ctx)
 	result := map[string]MeterAggregatesData{}
-	err := c.apiGetJson("meters/aggregates", &result)
+	err := c.apiGetJson(ctx, "meters/aggregates", &result)
 	return &result, err
 }
 
@@ -101,6 +112,8 @@ type MeterData struct {
 		Ct2 string `json:"ct2"`
 		Ct3 string `json:"ct3"`
 	} `json:"ct_voltage_references"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetMeters fetches detailed meter data for each meter under the specified
@@ -112,8 +125,14 @@ type MeterData struct {
 //
 // See the MeterData type for more information on what fields this returns.
 func (c *Client) GetMeters(category string) (*[]MeterData, error) {
-	c.checkLogin()
+	return c.GetMetersContext(context.Background(), category)
+}
+
+// GetMetersContext is the same as GetMeters, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetMetersContext(ctx context.Context, category string) (*[]MeterData, error) {
+	c.checkLogin(ctx)
 	result := []MeterData{}
-	err := c.apiGetJson("meters/"+url.PathEscape(category), &result)
+	err := c.apiGetJson(ctx, "meters/"+url.PathEscape(category), &result)
 	return &result, err
 }
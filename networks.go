@@ -1,9 +1,12 @@
 // Functions for reading network interface info:
 //
 //   (*Client) GetNetworks()
+//   (*Client) GetNetworksContext(ctx)
 //
 package powerwall
 
+import "context"
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // NetworkData contains information returned by the "networks" API call for a
@@ -38,6 +41,8 @@ type NetworkData struct {
 	} `json:"iface_network_info"`
 	SecurityType string `json:"security_type"`
 	Username     string `json:"username"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetNetworks returns information about all of the network interfaces in the
@@ -45,8 +50,14 @@ type NetworkData struct {
 //
 // See the NetworkData type for more information on what fields this returns.
 func (c *Client) GetNetworks() (*[]NetworkData, error) {
-	c.checkLogin()
+	return c.GetNetworksContext(context.Background())
+}
+
+// GetNetworksContext is the same as GetNetworks, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetNetworksContext(ctx context.Context) (*[]NetworkData, error) {
+	c.checkLogin(ctx)
 	result := []NetworkData{}
-	err := c.apiGetJson("networks", &result)
+	err := c.apiGetJson(ctx, "networks", &result)
 	return &result, err
 }
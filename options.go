@@ -0,0 +1,284 @@
+// Options which can be passed to NewClientWithOptions:
+//
+//   WithLogin(email, password)
+//   WithInstallerLogin(email, password, forceSmOff)
+//   WithCredentials(provider)
+//   WithTransport(transport)
+//   WithTimeout(timeout)
+//   WithSitemasterTimeout(timeout)
+//   WithTLSConfig(config)
+//   WithServerName(name)
+//   WithPort(port)
+//   WithUserAgent(userAgent)
+//   WithLogger(logFunc)
+//   WithBaseURL(baseURL)
+//   WithTokenStore(store)
+//   WithDecodePolicy(policy)
+//   WithSchemaCheck(fn)
+//
+package powerwall
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Option is a configuration option which can be passed to
+// NewClientWithOptions to customize the behavior of the created Client.
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	credentials  CredentialProvider
+	username     string
+	forceSmOff   bool
+	transport    http.RoundTripper
+	timeout      time.Duration
+	smTimeout    time.Duration
+	tlsConfig    *tls.Config
+	serverName   string
+	port         int
+	userAgent    string
+	logFunc      func(...interface{})
+	baseURL      string
+	tokenStore   TokenStore
+	decodePolicy DecodePolicy
+	schemaCheck  bool
+	schemaFunc   func(SchemaDrift)
+}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		timeout:   time.Second * 2,  // Timeout after 2 seconds
+		smTimeout: time.Second * 60, // Wait up to 60 seconds for sitemaster
+		// The TEG apparently requires a valid SNI hostname matching
+		// its cert, or it will just bomb out and terminate the
+		// connection during TLS negotiation (even if we're not
+		// checking the cert), so we override the TLS ServerName to
+		// use one of its (hardcoded) stock names for all connections.
+		serverName:   "powerwall",
+		port:         443,
+		credentials:  StaticCredentials{},
+		username:     loginUsernameCustomer,
+		decodePolicy: DecodeFail,
+	}
+}
+
+// httpClient creates a new http.Client based on the options.
+func (o *clientOptions) httpClient() http.Client {
+	transport := o.transport
+	if transport == nil {
+		tlsConfig := o.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = o.serverName
+		}
+		transport = &http.Transport{
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	return http.Client{
+		Transport: transport,
+		Timeout:   o.timeout,
+	}
+}
+
+// WithLogin sets the email address and password to use when logging into the
+// gateway.  (See NewClient for more information)
+func WithLogin(email string, password string) Option {
+	return func(o *clientOptions) {
+		o.credentials = StaticCredentials{Email: email, Password: password}
+		o.username = loginUsernameCustomer
+		o.forceSmOff = false
+	}
+}
+
+// WithInstallerLogin is the same as WithLogin, but logs in as "installer"
+// instead of "customer".  Installer logins are granted the
+// RoleProviderEngineer role, which is required for some APIs (such as
+// GoOffGrid) that are not available to customer logins.
+//
+// If forceSmOff is true, the gateway is asked to stop the sitemaster when
+// logging in (this is what the gateway's own installer wizard does).  Note
+// that it will then stay stopped until StartSitemaster is called.
+func WithInstallerLogin(email string, password string, forceSmOff bool) Option {
+	return func(o *clientOptions) {
+		o.credentials = StaticCredentials{Email: email, Password: password}
+		o.username = loginUsernameInstaller
+		o.forceSmOff = forceSmOff
+	}
+}
+
+// WithCredentials sets a CredentialProvider which will be asked for the email
+// address and password every time the client needs to login, instead of using
+// a fixed email and password (as WithLogin does).  This avoids the client
+// holding on to the password for its whole lifetime, and allows it to be
+// changed without creating a new client.
+//
+// To use a CredentialProvider with an installer login, pass this option after
+// WithInstallerLogin (the email and password given to WithInstallerLogin will
+// then be ignored).
+func WithCredentials(provider CredentialProvider) Option {
+	return func(o *clientOptions) {
+		o.credentials = provider
+	}
+}
+
+// WithTransport sets the http.RoundTripper which will be used for all HTTP
+// requests made by the client.  This can be used to route requests through a
+// proxy, add instrumentation, or substitute a fake gateway for testing, etc.
+//
+// Note that if this option is used, the WithTLSConfig and WithServerName
+// options have no effect, and SetTLSCert will not work unless the supplied
+// transport is an *http.Transport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *clientOptions) {
+		o.transport = transport
+	}
+}
+
+// WithTimeout sets the overall timeout for each HTTP request made to the
+// gateway (default 2 seconds).  A timeout of zero means no timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithSitemasterTimeout sets the maximum amount of time StopSitemaster and
+// StartSitemaster will wait for the sitemaster to actually stop or start
+// before giving up (default 60 seconds).  This does not apply to the Context
+// variants of those functions, which use the context's deadline instead, if
+// any.
+func WithSitemasterTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.smTimeout = timeout
+	}
+}
+
+// WithTLSConfig sets the TLS configuration to use when connecting to the
+// gateway.  The provided config is copied, so later changes to it will not
+// affect the client.  If the config does not specify a ServerName, the one
+// set by WithServerName (or the default) will be used.
+//
+// By default, the client does not validate the gateway's certificate (see
+// SetTLSCert), but note that this is not the case if you supply your own
+// config, unless you set InsecureSkipVerify in it yourself.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *clientOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// WithServerName sets the SNI hostname which will be sent when establishing
+// TLS connections to the gateway.  The default is "powerwall", which is one of
+// the names built into the gateway's certificate.
+func WithServerName(name string) Option {
+	return func(o *clientOptions) {
+		o.serverName = name
+	}
+}
+
+// WithPort sets the TCP port to connect to on the gateway (default 443).
+func WithPort(port int) Option {
+	return func(o *clientOptions) {
+		o.port = port
+	}
+}
+
+// WithUserAgent sets the User-Agent header which will be sent with all HTTP
+// requests.  By default, Go's standard User-Agent is used.
+func WithUserAgent(userAgent string) Option {
+	return func(o *clientOptions) {
+		o.userAgent = userAgent
+	}
+}
+
+// WithLogger sets a debug logging function for this client only, overriding
+// the global one set by SetLogFunc.  The provided function should accept
+// arguments in the same format as SetLogFunc.
+func WithLogger(logFunc func(...interface{})) Option {
+	return func(o *clientOptions) {
+		o.logFunc = logFunc
+	}
+}
+
+// WithBaseURL sets the base URL of the server to connect to.  This is only used
+// by CloudClient (see NewCloudClient), where it defaults to Tesla's Owner API
+// server.  It can be used to connect to the Fleet API instead, or to a fake
+// server for testing.
+func WithBaseURL(baseURL string) Option {
+	return func(o *clientOptions) {
+		o.baseURL = baseURL
+	}
+}
+
+// WithTokenStore sets a TokenStore which the client will use to persist its
+// auth token.  The client loads its initial token from the store when it is
+// created, and saves the new token to the store every time it logs in, so the
+// token can be re-used by later clients (or other processes) without needing
+// to log in again.  (See NewFileTokenStore, etc.)
+func WithTokenStore(store TokenStore) Option {
+	return func(o *clientOptions) {
+		o.tokenStore = store
+	}
+}
+
+// DecodePolicy determines what a Client does when a response from the gateway
+// contains fields which cannot be decoded (see WithDecodePolicy).
+type DecodePolicy int
+
+// Possible DecodePolicy values:
+const (
+	// Fail the call with the error returned by encoding/json if any
+	// fields cannot be decoded (fields the library does not know about
+	// are ignored).  This is the default, and is how the library has
+	// always behaved.
+	DecodeFail DecodePolicy = iota
+	// Silently ignore fields which cannot be decoded (they are left as
+	// zero values), and return everything else.
+	DecodeLenient
+	// The same as DecodeLenient, but also report the problems (as a
+	// DecodeError) using the function registered with SetErrFunc.
+	DecodeWarn
+	// Fail the call with a DecodeError if any fields cannot be decoded, or
+	// if the response contains any fields the library does not know about.
+	// This is mainly useful for testing.
+	DecodeStrict
+)
+
+// WithDecodePolicy sets what the client does when a response from the gateway
+// contains fields which do not match what the library expects (for example,
+// a field which has changed type in a new firmware version).  The default is
+// DecodeFail, which means the call fails.  DecodeWarn or DecodeLenient can be
+// used so that a single bad field will not cause the whole call to fail.
+func WithDecodePolicy(policy DecodePolicy) Option {
+	return func(o *clientOptions) {
+		o.decodePolicy = policy
+	}
+}
+
+// WithSchemaCheck enables checking of all JSON API responses against what the
+// library expects them to contain.  Any fields which the library does not know
+// about are saved in the Extra field of the returned struct, and any
+// differences (new fields, missing fields, fields whose type has changed, etc)
+// are reported by calling fn with a SchemaDrift describing each one.  If fn is
+// nil, they are reported using the function registered with SetErrFunc
+// instead.
+//
+// Each difference is only reported once per client (for a given API and
+// firmware version), so it is safe to leave this enabled for clients which
+// poll the gateway continuously.  This is intended to help find out about
+// changes to the API in new firmware versions before they break things.
+func WithSchemaCheck(fn func(SchemaDrift)) Option {
+	return func(o *clientOptions) {
+		o.schemaCheck = true
+		o.schemaFunc = fn
+	}
+}
@@ -0,0 +1,314 @@
+package powerwalltest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Redacted is the value which sensitive information is replaced with when
+// recording.
+const Redacted = "REDACTED"
+
+// JSON keys whose (string) values are replaced with Redacted in recorded
+// request and response bodies:
+var redactedKeys = map[string]bool{
+	"email":          true, // login/Basic request and response
+	"password":       true, // login/Basic request
+	"token":          true, // login/Basic response
+	"client_cert":    true, // MeterData https_conf
+	"client_key":     true, // MeterData https_conf
+	"server_ca_cert": true, // MeterData https_conf
+}
+
+// Interaction is a single recorded request/response pair.
+type Interaction struct {
+	Method string `json:"method"`
+	// API is the API path requested, without the leading "/api/" (for
+	// example "system_status/soe").
+	API          string `json:"api"`
+	RequestBody  string `json:"request_body,omitempty"`
+	StatusCode   int    `json:"status_code"`
+	ContentType  string `json:"content_type,omitempty"`
+	ResponseBody string `json:"response_body"`
+	// Base64 indicates that the bodies were not valid UTF-8 text (for
+	// example, protobuf data), and have been base64-encoded.
+	Base64 bool `json:"base64,omitempty"`
+}
+
+func (i *Interaction) decode(body string) []byte {
+	if i.Base64 {
+		data, _ := base64.StdEncoding.DecodeString(body)
+		return data
+	}
+	return []byte(body)
+}
+
+// Cassette is a recording of the traffic between a client and a real gateway,
+// which can be saved to a file and later played back using a ReplayTransport
+// or a Server.
+type Cassette struct {
+	// Version is the gateway firmware version, if a "status" call was
+	// recorded.
+	Version      string        `json:"version,omitempty"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// LoadCassette reads a cassette from the specified file.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Cassette{}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cassette file %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette to the specified file.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// Recorder is an http.RoundTripper which passes requests through to another
+// RoundTripper, and records each request and response into a Cassette.  Auth
+// cookies, login details, tokens, and meter certificates/keys are redacted from
+// the recording, so it can be safely shared.
+//
+// To record a session with a real gateway, supply a Recorder to
+// powerwall.NewClientWithOptions using the WithTransport option.  (Note that
+// the Recorder's transport will then need to be configured for connecting to
+// the gateway, as WithTLSConfig and WithServerName will have no effect.)
+type Recorder struct {
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	cassette  Cassette
+}
+
+// NewRecorder creates a new Recorder which sends requests using the provided
+// transport.
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	return &Recorder{transport: transport}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	i := Interaction{
+		Method:      req.Method,
+		API:         strings.TrimPrefix(req.URL.Path, "/api/"),
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	reqBody = redact(reqBody)
+	respBody = redact(respBody)
+	if utf8.Valid(reqBody) && utf8.Valid(respBody) {
+		i.RequestBody = string(reqBody)
+		i.ResponseBody = string(respBody)
+	} else {
+		i.Base64 = true
+		i.RequestBody = base64.StdEncoding.EncodeToString(reqBody)
+		i.ResponseBody = base64.StdEncoding.EncodeToString(respBody)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if i.API == "status" && i.StatusCode == http.StatusOK {
+		status := struct {
+			Version string `json:"version"`
+		}{}
+		if json.Unmarshal(respBody, &status) == nil {
+			r.cassette.Version = status.Version
+		}
+	}
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+	return resp, nil
+}
+
+// Cassette returns a copy of everything recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c := r.cassette
+	c.Interactions = append([]Interaction{}, r.cassette.Interactions...)
+	return &c
+}
+
+// redact returns a copy of a JSON body with the values of any redactedKeys
+// replaced.  Bodies which are not JSON are returned unchanged.  (Note that
+// cookies are never recorded, so they do not need to be redacted.)
+func redact(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// Preserve numbers exactly as the gateway sent them.
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+	if !redactValue(v) {
+		return body
+	}
+	result, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return result
+}
+
+// redactValue redacts sensitive fields within a decoded JSON value in place,
+// and returns whether anything was changed.
+func redactValue(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && redactedKeys[k] && s != "" {
+				v[k] = Redacted
+				changed = true
+			} else if redactValue(child) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactValue(child) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// ReplayTransport is an http.RoundTripper which answers requests using the
+// responses recorded in a Cassette, without making any network connections.
+// It can be supplied to powerwall.NewClientWithOptions using the
+// WithTransport option.
+//
+// Requests are matched by method and API path.  If the same call was
+// recorded more than once, the recorded responses are returned in order, and
+// the last one is repeated once they run out.  Requests which do not match
+// anything in the cassette get a 404 response.
+type ReplayTransport struct {
+	mutex    sync.Mutex
+	cassette *Cassette
+	next     map[string]int
+}
+
+// NewReplayTransport creates a new ReplayTransport which plays back the
+// provided cassette.
+func NewReplayTransport(c *Cassette) *ReplayTransport {
+	return &ReplayTransport{
+		cassette: c,
+		next:     map[string]int{},
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	api := strings.TrimPrefix(req.URL.Path, "/api/")
+	key := req.Method + " " + api
+
+	t.mutex.Lock()
+	var matches []*Interaction
+	for idx := range t.cassette.Interactions {
+		i := &t.cassette.Interactions[idx]
+		if i.Method == req.Method && i.API == api {
+			matches = append(matches, i)
+		}
+	}
+	n := t.next[key]
+	if n < len(matches)-1 {
+		t.next[key] = n + 1
+	}
+	t.mutex.Unlock()
+
+	var status int
+	var body []byte
+	contentType := "application/json"
+	if len(matches) == 0 {
+		status, body = errorBody(http.StatusNotFound, "not found", "No recorded response")
+	} else {
+		i := matches[n]
+		status = i.StatusCode
+		body = i.decode(i.ResponseBody)
+		contentType = i.ContentType
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// LoadCassette sets the server's fixtures from the successful GET responses
+// recorded in the provided cassette (if a call was recorded more than once,
+// the last response is used).  Logins and other server behavior are not
+// affected.
+func (s *Server) LoadCassette(c *Cassette) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for idx := range c.Interactions {
+		i := &c.Interactions[idx]
+		if i.Method != http.MethodGet || i.StatusCode < 200 || i.StatusCode >= 300 {
+			continue
+		}
+		s.fixtures[i.API] = i.decode(i.ResponseBody)
+	}
+}
@@ -0,0 +1,89 @@
+package powerwalltest_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	s.SetFixture("system_status/soe", powerwall.SOEData{Percentage: 42})
+	s.SetLogin("owner@example.com", "hunter2")
+
+	recorder := powerwalltest.NewRecorder(s.Client().Transport)
+	client := s.NewClient(powerwall.WithLogger(t.Log), powerwall.WithTransport(recorder))
+	defer client.Close()
+	if _, err := client.GetStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetSOE(); err != nil {
+		t.Fatal(err)
+	}
+	token := client.GetAuthToken()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := recorder.Cassette().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := powerwalltest.LoadCassette(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Version != "22.1.1 3ed0c5e5" {
+		t.Errorf("unexpected cassette version %q", c.Version)
+	}
+	var login *powerwalltest.Interaction
+	for i := range c.Interactions {
+		if c.Interactions[i].API == "login/Basic" {
+			login = &c.Interactions[i]
+		}
+	}
+	if login == nil {
+		t.Fatalf("login was not recorded: %+v", c.Interactions)
+	}
+	// Nothing sensitive should have made it into the recording.
+	for _, body := range []string{login.RequestBody, login.ResponseBody} {
+		if !strings.Contains(body, powerwalltest.Redacted) {
+			t.Errorf("login body was not redacted: %s", body)
+		}
+		for _, secret := range []string{"owner@example.com", "hunter2", token} {
+			if strings.Contains(body, secret) {
+				t.Errorf("login body contains %q: %s", secret, body)
+			}
+		}
+	}
+
+	// Playing it back should give the same results, without a server.
+	replay := powerwall.NewClientWithOptions("powerwall",
+		powerwall.WithLogger(t.Log),
+		powerwall.WithLogin(powerwalltest.DefaultEmail, powerwalltest.DefaultPassword),
+		powerwall.WithTransport(powerwalltest.NewReplayTransport(c)),
+	)
+	defer replay.Close()
+	soe, err := replay.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage != 42 {
+		t.Errorf("unexpected replayed SOE %+v", soe)
+	}
+	if _, err := replay.GetGridStatus(); err == nil {
+		t.Errorf("expected an error for a call which was not recorded")
+	}
+
+	// It can also be loaded into a server as fixtures.
+	s2 := powerwalltest.NewServer()
+	defer s2.Close()
+	s2.LoadCassette(c)
+	client2 := s2.NewClient(powerwall.WithLogger(t.Log))
+	defer client2.Close()
+	if soe, err := client2.GetSOE(); err != nil || soe.Percentage != 42 {
+		t.Errorf("cassette fixtures not loaded: %+v, %v", soe, err)
+	}
+}
@@ -0,0 +1,193 @@
+package powerwalltest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// Default values used by a new CloudServer:
+const (
+	DefaultSiteID      = "1234567890"
+	DefaultAccessToken = "test-access-token"
+)
+
+// CloudServer is a fake version of Tesla's cloud API (the energy site
+// endpoints of the "Owner API"), for testing code which uses
+// powerwall.CloudClient.  Like Server, it embeds an *httptest.Server and
+// records all of the requests made to it.
+//
+// The cloud API reports the backup reserve in the same units as the Tesla
+// app, so the "site_info" fixture (and the value stored by a POST to
+// "backup") uses those units, not the raw units used by the local API.
+type CloudServer struct {
+	*httptest.Server
+
+	mutex       sync.Mutex
+	siteID      string
+	accessToken string
+	fixtures    map[string]map[string]interface{}
+	requests    []Request
+}
+
+// NewCloudServer creates and starts a new fake cloud server for a single
+// energy site (DefaultSiteID), which accepts DefaultAccessToken.  The caller
+// should call Close when finished with it.
+func NewCloudServer() *CloudServer {
+	s := &CloudServer{
+		siteID:      DefaultSiteID,
+		accessToken: DefaultAccessToken,
+		fixtures: map[string]map[string]interface{}{
+			"site_info": {
+				"id":                     DefaultSiteID,
+				"site_name":              "Test Site",
+				"backup_reserve_percent": float64(20),
+				"default_real_mode":      powerwall.OperationModeSelf,
+				"version":                "22.1.1 3ed0c5e5",
+			},
+			"live_status": {
+				"solar_power":          float64(3000),
+				"energy_left":          float64(10125),
+				"total_pack_energy":    float64(13500),
+				"percentage_charged":   float64(75),
+				"battery_power":        float64(-500),
+				"load_power":           float64(2000),
+				"grid_status":          "Active",
+				"grid_power":           float64(-500),
+				"island_status":        "on_grid",
+				"grid_services_active": false,
+				"timestamp":            "2022-01-01T12:00:00Z",
+			},
+		},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// NewClient returns a new powerwall.CloudClient which is configured to
+// connect to this server, using DefaultSiteID and the server's current access
+// token.  Any additional options are applied after the ones needed to
+// connect.
+func (s *CloudServer) NewClient(options ...powerwall.Option) *powerwall.CloudClient {
+	s.mutex.Lock()
+	opts := []powerwall.Option{
+		powerwall.WithBaseURL(s.URL),
+		powerwall.WithTransport(s.Client().Transport),
+	}
+	siteID, token := s.siteID, s.accessToken
+	s.mutex.Unlock()
+	return powerwall.NewCloudClient(siteID, token, append(opts, options...)...)
+}
+
+// SetAccessToken changes the access token which the server will accept.
+// Requests made with any other token will get a 401 response.
+func (s *CloudServer) SetAccessToken(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.accessToken = token
+}
+
+// SetField changes a single field of the response for the specified API
+// ("site_info" or "live_status").
+func (s *CloudServer) SetField(api string, name string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fixtures[api] == nil {
+		s.fixtures[api] = map[string]interface{}{}
+	}
+	s.fixtures[api][name] = value
+}
+
+// Field returns the current value of a single field of the response for the
+// specified API (for example, to check what a POST to "backup" stored).
+func (s *CloudServer) Field(api string, name string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fixtures[api][name]
+}
+
+// Requests returns a list of all of the requests made to the server so far,
+// in the order they were received.  (The API field is the part of the path
+// after the site ID, for example "live_status".)
+func (s *CloudServer) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *CloudServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mutex.Lock()
+	prefix := "/api/1/energy_sites/" + s.siteID + "/"
+	api := strings.TrimPrefix(r.URL.Path, prefix)
+	authenticated := token == s.accessToken
+	s.requests = append(s.requests, Request{
+		Time:          time.Now(),
+		Method:        r.Method,
+		API:           api,
+		Body:          body,
+		Token:         token,
+		Authenticated: authenticated,
+	})
+	s.mutex.Unlock()
+
+	if !authenticated {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid bearer token\n"))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusNotFound, "not found", "Not Found")
+		return
+	}
+
+	var resp interface{}
+	switch {
+	case r.Method == http.MethodGet:
+		s.mutex.Lock()
+		fixture, ok := s.fixtures[api]
+		if ok {
+			// Copy it, so it can be encoded after the mutex is released.
+			copied := map[string]interface{}{}
+			for k, v := range fixture {
+				copied[k] = v
+			}
+			resp = copied
+		}
+		s.mutex.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "not found", "Not Found")
+			return
+		}
+	case r.Method == http.MethodPost && (api == "operation" || api == "backup"):
+		req := map[string]interface{}{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+		s.mutex.Lock()
+		if v, ok := req["default_real_mode"]; ok && api == "operation" {
+			s.fixtures["site_info"]["default_real_mode"] = v
+		}
+		if v, ok := req["backup_reserve_percent"]; ok && api == "backup" {
+			s.fixtures["site_info"]["backup_reserve_percent"] = v
+		}
+		s.mutex.Unlock()
+		resp = map[string]interface{}{"code": 201, "message": "Updated"}
+	default:
+		writeError(w, http.StatusNotFound, "not found", "Not Found")
+		return
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"response": resp})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,230 @@
+package powerwalltest
+
+// defaultFixtures contains the responses a new Server returns for each API.
+// These are based on responses from a real gateway (a single Powerwall 2 with
+// solar, connected to the grid), with identifying information replaced.
+var defaultFixtures = map[string]string{
+	"status": `{
+		"din": "1232100-00-E--TG000000000000",
+		"start_time": "2022-01-01 12:00:00 +0000",
+		"up_time_seconds": "123h45m6.789s",
+		"is_new": false,
+		"version": "22.1.1 3ed0c5e5",
+		"git_hash": "3ed0c5e5a2b4e2e4c5e3f3e8c2b9c1a5e4d3f2b1",
+		"commission_count": 0,
+		"device_type": "teg",
+		"sync_type": "v2.1",
+		"leader": "",
+		"followers": null,
+		"cellular_disabled": false
+	}`,
+
+	"site_info": `{
+		"site_name": "Test Site",
+		"timezone": "America/Los_Angeles",
+		"max_site_meter_power_kW": 1000000000,
+		"min_site_meter_power_kW": -1000000000,
+		"measured_frequency": 60,
+		"max_system_energy_kWh": 13.5,
+		"max_system_power_kW": 5,
+		"nominal_system_energy_kWh": 13.5,
+		"nominal_system_power_kW": 5,
+		"grid_code": {
+			"grid_code": "60Hz_240V_s_UL1741SA:2019_California",
+			"grid_voltage_setting": 240,
+			"grid_freq_setting": 60,
+			"grid_phase_setting": "Split",
+			"country": "United States",
+			"state": "California",
+			"distributor": "*",
+			"utility": "Pacific Gas & Electric",
+			"retailer": "*",
+			"region": "UL1741SA"
+		}
+	}`,
+
+	"sitemaster": `{
+		"status": "StatusUp",
+		"running": true,
+		"connected_to_tesla": true,
+		"power_supply_mode": false,
+		"can_reboot": "Yes"
+	}`,
+
+	"system_status": `{
+		"command_source": "Configuration",
+		"battery_target_power": -250,
+		"battery_target_reactive_power": 0,
+		"nominal_full_pack_energy": 13500,
+		"nominal_energy_remaining": 10125,
+		"max_power_energy_remaining": 0,
+		"max_power_energy_to_be_charged": 0,
+		"max_charge_power": 5000,
+		"max_discharge_power": 5000,
+		"max_apparent_power": 5000,
+		"instantaneous_max_discharge_power": 7000,
+		"instantaneous_max_charge_power": 7000,
+		"grid_services_power": 0,
+		"system_island_state": "SystemGridConnected",
+		"available_blocks": 1,
+		"battery_blocks": [{
+			"Type": "",
+			"PackagePartNumber": "2012170-25-E",
+			"PackageSerialNumber": "TG000000000001",
+			"disabled_reasons": [],
+			"pinv_state": "PINV_GridFollowing",
+			"pinv_grid_state": "Grid_Compliant",
+			"nominal_energy_remaining": 10125,
+			"nominal_full_pack_energy": 13500,
+			"p_out": -250,
+			"q_out": 0,
+			"v_out": 243.5,
+			"f_out": 60.0,
+			"i_out": -1.0,
+			"energy_charged": 1000000,
+			"energy_discharged": 900000,
+			"off_grid": false,
+			"vf_mode": false,
+			"wobble_detected": false,
+			"charge_power_clamped": false,
+			"backup_ready": true,
+			"OpSeqState": "Active",
+			"version": "3ed0c5e5a2b4e2e4"
+		}],
+		"ffr_power_availability_high": 0,
+		"ffr_power_availability_low": 0,
+		"load_charge_constraint": 0,
+		"max_sustained_ramp_rate": 2500000,
+		"grid_faults": [],
+		"can_reboot": "Yes",
+		"smart_inv_delta_p": 0,
+		"smart_inv_delta_q": 0,
+		"last_toggle_timestamp": "2022-01-01T12:00:00.000000000-08:00",
+		"solar_real_power_limit": -1,
+		"score": 10000,
+		"blocks_controlled": 1,
+		"primary": true,
+		"auxiliary_load": 0,
+		"all_enable_lines_high": true,
+		"inverter_nominal_usable_power": 5000,
+		"expected_energy_remaining": 0
+	}`,
+
+	"system_status/soe": `{"percentage": 75}`,
+
+	"system_status/grid_status": `{
+		"grid_status": "SystemGridConnected",
+		"grid_services_active": false
+	}`,
+
+	"system_status/grid_faults": `[]`,
+
+	"operation": `{
+		"real_mode": "self_consumption",
+		"backup_reserve_percent": 24.6,
+		"freq_shift_load_shed_soe": 0,
+		"freq_shift_load_shed_delta_f": 0
+	}`,
+
+	"meters/aggregates": `{
+		"site": {
+			"last_communication_time": "2022-01-01T12:00:00.000000000-08:00",
+			"instant_power": 1250,
+			"instant_reactive_power": 0,
+			"instant_apparent_power": 1250,
+			"frequency": 60,
+			"energy_exported": 2000000,
+			"energy_imported": 3000000,
+			"instant_average_voltage": 243.5,
+			"instant_average_current": 5.1,
+			"i_a_current": 0,
+			"i_b_current": 0,
+			"i_c_current": 0,
+			"last_phase_voltage_communication_time": "0001-01-01T00:00:00Z",
+			"last_phase_power_communication_time": "0001-01-01T00:00:00Z",
+			"timeout": 1500000000,
+			"num_meters_aggregated": 1,
+			"instant_total_current": 5.1
+		},
+		"battery": {
+			"last_communication_time": "2022-01-01T12:00:00.000000000-08:00",
+			"instant_power": -250,
+			"instant_reactive_power": 0,
+			"instant_apparent_power": 250,
+			"frequency": 60,
+			"energy_exported": 900000,
+			"energy_imported": 1000000,
+			"instant_average_voltage": 243.5,
+			"instant_average_current": -1.0,
+			"i_a_current": 0,
+			"i_b_current": 0,
+			"i_c_current": 0,
+			"last_phase_voltage_communication_time": "0001-01-01T00:00:00Z",
+			"last_phase_power_communication_time": "0001-01-01T00:00:00Z",
+			"timeout": 1500000000,
+			"num_meters_aggregated": 1,
+			"instant_total_current": -1.0
+		},
+		"load": {
+			"last_communication_time": "2022-01-01T12:00:00.000000000-08:00",
+			"instant_power": 2500,
+			"instant_reactive_power": 0,
+			"instant_apparent_power": 2500,
+			"frequency": 60,
+			"energy_exported": 0,
+			"energy_imported": 6000000,
+			"instant_average_voltage": 243.5,
+			"instant_average_current": 10.2,
+			"i_a_current": 0,
+			"i_b_current": 0,
+			"i_c_current": 0,
+			"last_phase_voltage_communication_time": "0001-01-01T00:00:00Z",
+			"last_phase_power_communication_time": "0001-01-01T00:00:00Z",
+			"timeout": 1500000000,
+			"num_meters_aggregated": 1,
+			"instant_total_current": 10.2
+		},
+		"solar": {
+			"last_communication_time": "2022-01-01T12:00:00.000000000-08:00",
+			"instant_power": 1500,
+			"instant_reactive_power": 0,
+			"instant_apparent_power": 1500,
+			"frequency": 60,
+			"energy_exported": 4000000,
+			"energy_imported": 0,
+			"instant_average_voltage": 243.5,
+			"instant_average_current": 6.2,
+			"i_a_current": 0,
+			"i_b_current": 0,
+			"i_c_current": 0,
+			"last_phase_voltage_communication_time": "0001-01-01T00:00:00Z",
+			"last_phase_power_communication_time": "0001-01-01T00:00:00Z",
+			"timeout": 1000000000,
+			"num_meters_aggregated": 1,
+			"instant_total_current": 6.2
+		}
+	}`,
+
+	"networks": `[{
+		"network_name": "ethernet_tesla_internal_default",
+		"interface": "EthType",
+		"dhcp": true,
+		"enabled": true,
+		"active": true,
+		"primary": true,
+		"lastTeslaConnected": true,
+		"lastInternetConnected": true,
+		"iface_network_info": {
+			"network_name": "ethernet_tesla_internal_default",
+			"ip_networks": [{"ip": "192.168.1.50", "mask": "ffffff00"}],
+			"gateway": "192.168.1.1",
+			"interface": "EthType",
+			"state": "DeviceStateReady",
+			"state_reason": "DeviceStateReasonNone",
+			"signal_strength": 0,
+			"hw_address": "00:00:00:00:00:00"
+		},
+		"security_type": "NONE",
+		"username": ""
+	}]`,
+}
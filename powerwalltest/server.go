@@ -0,0 +1,512 @@
+// Package powerwalltest provides a fake Tesla Energy Gateway which can be used
+// for testing code which uses the powerwall library, without needing access to
+// a real gateway.
+//
+// The fake gateway is an httptest-based TLS server which implements the login
+// process (including AuthCookie handling and expiring tokens), and serves
+// configurable JSON responses ("fixtures") for the common API endpoints.  It
+// can also inject faults (latency, dropped connections, error status codes,
+// malformed JSON) into its responses, and records all of the requests made to
+// it so that tests can check what the client actually did:
+//
+//	s := powerwalltest.NewServer()
+//	defer s.Close()
+//	s.SetFixture("system_status/soe", powerwall.SOEData{Percentage: 42})
+//	client := s.NewClient()
+//	soe, err := client.GetSOE()
+package powerwalltest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// Default login credentials accepted by a new Server:
+const (
+	DefaultEmail    = "test@example.com"
+	DefaultPassword = "password"
+)
+
+// Request records a single request made to the fake gateway.
+type Request struct {
+	Time   time.Time
+	Method string
+	// API is the API path requested, without the leading "/api/" (for
+	// example "system_status/soe").
+	API  string
+	Body []byte
+	// Token is the value of the AuthCookie sent with the request (if
+	// any), and Authenticated is whether it was a currently-valid token.
+	Token         string
+	Authenticated bool
+}
+
+// Fault describes a problem to inject into the fake gateway's responses.
+// More than one type of fault can be specified at once (for example, Latency
+// combined with StatusCode).
+type Fault struct {
+	// Latency is an additional delay before responding.
+	Latency time.Duration
+	// Drop causes the connection to be closed without any response being
+	// sent, as if the gateway had dropped off the network.  (Note that
+	// Go's HTTP client will sometimes silently retry a request whose
+	// connection was dropped, so a Drop fault with a Count of 1 may not
+	// be noticed by the caller at all.)
+	Drop bool
+	// StatusCode, if non-zero, causes the response to be an error with the
+	// given status code (e.g. http.StatusInternalServerError).
+	StatusCode int
+	// Malformed causes the response body to be invalid (truncated) JSON.
+	Malformed bool
+	// Count is the number of requests the fault should apply to, after
+	// which it is automatically removed.  Zero means it will apply to all
+	// requests until it is cleared with ClearFaults.
+	Count int
+}
+
+// Server is a fake Tesla Energy Gateway.  It embeds an *httptest.Server, so
+// the URL, Client, and Close functions of that type are also available.
+//
+// All of the Server's functions are safe to call while requests are being
+// processed.
+type Server struct {
+	*httptest.Server
+
+	mutex         sync.Mutex
+	email         string
+	password      string
+	tokenLifetime time.Duration
+	tokens        map[string]issuedToken
+	lockoutAfter  int
+	lockoutPeriod time.Duration
+	failedLogins  int
+	lockedUntil   time.Time
+	fixtures      map[string][]byte
+	faults        map[string]*Fault
+	requests      []Request
+}
+
+// NewServer creates and starts a new fake gateway with a default set of
+// fixtures, which accepts the login credentials DefaultEmail and
+// DefaultPassword.  The caller should call Close when finished with it.
+func NewServer() *Server {
+	s := &Server{
+		email:    DefaultEmail,
+		password: DefaultPassword,
+		tokens:   map[string]issuedToken{},
+		fixtures: map[string][]byte{},
+		faults:   map[string]*Fault{},
+	}
+	for api, body := range defaultFixtures {
+		s.fixtures[api] = []byte(body)
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// NewClient returns a new powerwall.Client which is configured to connect to
+// this server (and to trust its TLS certificate), using the server's current
+// login credentials.  Any additional options are applied after the ones
+// needed to connect.
+func (s *Server) NewClient(options ...powerwall.Option) *powerwall.Client {
+	host, port := s.Address()
+	s.mutex.Lock()
+	opts := []powerwall.Option{
+		powerwall.WithLogin(s.email, s.password),
+		powerwall.WithPort(port),
+		powerwall.WithTransport(s.Client().Transport),
+	}
+	s.mutex.Unlock()
+	return powerwall.NewClientWithOptions(host, append(opts, options...)...)
+}
+
+// Address returns the host and port the server is listening on.
+func (s *Server) Address() (string, int) {
+	addr := s.Listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// SetLogin changes the email and password which the server will accept for
+// logins.
+func (s *Server) SetLogin(email string, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.email = email
+	s.password = password
+}
+
+// SetTokenLifetime sets how long auth tokens issued by the server remain
+// valid.  Requests made with an expired token will get a 401 response.  Zero
+// (the default) means tokens never expire.
+func (s *Server) SetTokenLifetime(lifetime time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokenLifetime = lifetime
+}
+
+// ExpireTokens immediately invalidates all auth tokens which have been issued
+// so far, so the next authenticated request will get a 401 response.
+func (s *Server) ExpireTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = map[string]issuedToken{}
+}
+
+// SetLoginLockout makes the server lock out logins for the specified period
+// after maxFailures consecutive failed login attempts, the same as a real
+// gateway does.  While locked out, all login attempts (even with the correct
+// credentials) get a 429 response.  A maxFailures of zero (the default)
+// disables lockouts.
+func (s *Server) SetLoginLockout(maxFailures int, period time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lockoutAfter = maxFailures
+	s.lockoutPeriod = period
+	s.failedLogins = 0
+	s.lockedUntil = time.Time{}
+}
+
+// SetFixture sets the response which will be returned for GET requests to the
+// specified API (for example "system_status/soe").  value is normally one of
+// the powerwall data types, which will be encoded as JSON.  If value is a
+// []byte or json.RawMessage, it will be returned as-is instead.
+//
+// Setting a fixture for an API which the server does not otherwise know about
+// will also cause that API to be served.
+func (s *Server) SetFixture(api string, value interface{}) error {
+	var body []byte
+	var err error
+	switch v := value.(type) {
+	case []byte:
+		body = v
+	case json.RawMessage:
+		body = v
+	default:
+		body, err = json.Marshal(value)
+		if err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fixtures[api] = body
+	return nil
+}
+
+// RemoveFixture removes the fixture for the specified API, so that requests
+// for it will get a 404 response.
+func (s *Server) RemoveFixture(api string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.fixtures, api)
+}
+
+// SetFault injects a fault into responses for the specified API.  An api of
+// "*" applies the fault to all requests (including logins), unless there is
+// also a fault set for the specific API being requested.
+func (s *Server) SetFault(api string, fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[api] = &fault
+}
+
+// ClearFaults removes all faults set with SetFault.
+func (s *Server) ClearFaults() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = map[string]*Fault{}
+}
+
+// Requests returns a list of all of the requests made to the server so far,
+// in the order they were received.
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// ResetRequests clears the list of recorded requests.
+func (s *Server) ResetRequests() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// APIs which can be called without logging in first:
+var publicAPIs = map[string]bool{
+	"login/Basic": true,
+	"status":      true,
+}
+
+// APIs which can only be called with an installer login:
+var installerAPIs = map[string]bool{
+	"v2/islanding/mode": true,
+}
+
+// issuedToken records information about an auth token the server has issued.
+type issuedToken struct {
+	issued    time.Time
+	installer bool
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	api := strings.TrimPrefix(r.URL.Path, "/api/")
+	token := ""
+	if cookie, err := r.Cookie("AuthCookie"); err == nil {
+		token = cookie.Value
+	}
+
+	s.mutex.Lock()
+	authenticated := s.checkToken(token)
+	installer := authenticated && s.tokens[token].installer
+	s.requests = append(s.requests, Request{
+		Time:          time.Now(),
+		Method:        r.Method,
+		API:           api,
+		Body:          body,
+		Token:         token,
+		Authenticated: authenticated,
+	})
+	fault := s.takeFault(api)
+	s.mutex.Unlock()
+
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.Drop {
+		dropConnection(w)
+		return
+	}
+	if fault.StatusCode != 0 {
+		writeError(w, fault.StatusCode, http.StatusText(fault.StatusCode), "Injected fault")
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, http.StatusNotFound, "not found", "Not Found")
+		return
+	}
+	if !publicAPIs[api] && !authenticated {
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, "missing token", "Unable to GET to resource")
+		} else {
+			writeError(w, http.StatusUnauthorized, "token expired", "Invalid Token")
+		}
+		return
+	}
+	if installerAPIs[api] && !installer {
+		writeError(w, http.StatusForbidden, "User does not have adequate access rights", "User does not have adequate access rights")
+		return
+	}
+
+	status, resp := s.dispatch(r.Method, api, body)
+	if fault.Malformed {
+		// Chop off the end so it will not parse.
+		resp = resp[:len(resp)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// checkToken returns whether the provided token is currently valid.  (This
+// must be called with the mutex held.)
+func (s *Server) checkToken(token string) bool {
+	t, ok := s.tokens[token]
+	if !ok {
+		return false
+	}
+	if s.tokenLifetime > 0 && time.Since(t.issued) > s.tokenLifetime {
+		delete(s.tokens, token)
+		return false
+	}
+	return true
+}
+
+// takeFault returns the fault (if any) which applies to this request, and
+// counts it against the fault's Count.  (This must be called with the mutex
+// held.)
+func (s *Server) takeFault(api string) Fault {
+	key := api
+	f, ok := s.faults[key]
+	if !ok {
+		key = "*"
+		f, ok = s.faults[key]
+	}
+	if !ok {
+		return Fault{}
+	}
+	if f.Count > 0 {
+		f.Count--
+		if f.Count == 0 {
+			delete(s.faults, key)
+		}
+	}
+	return *f
+}
+
+// dispatch produces the response for a (non-faulted, authenticated) request.
+func (s *Server) dispatch(method string, api string, body []byte) (int, []byte) {
+	switch {
+	case api == "login/Basic" && method == http.MethodPost:
+		return s.login(body)
+	case api == "operation" && method == http.MethodPost:
+		return s.postOperation(body)
+	case api == "sitemaster/stop" && method == http.MethodPost:
+		s.setSitemasterStatus(powerwall.SitemasterStatusDown, false)
+		return http.StatusAccepted, []byte("{}")
+	case api == "sitemaster/run" && method == http.MethodGet:
+		s.setSitemasterStatus(powerwall.SitemasterStatusUp, true)
+		return http.StatusAccepted, []byte("{}")
+	case api == "config/completed" && method == http.MethodGet:
+		return http.StatusAccepted, []byte("{}")
+	case api == "v2/islanding/mode" && method == http.MethodPost:
+		return http.StatusOK, body
+	case method == http.MethodGet:
+		s.mutex.Lock()
+		resp, ok := s.fixtures[api]
+		s.mutex.Unlock()
+		if ok {
+			return http.StatusOK, resp
+		}
+	}
+	return errorBody(http.StatusNotFound, "not found", "Not Found")
+}
+
+func (s *Server) login(body []byte) (int, []byte) {
+	req := struct {
+		Username   string `json:"username"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		ForceSmOff bool   `json:"force_sm_off"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return errorBody(http.StatusBadRequest, "bad request", err.Error())
+	}
+	installer := req.Username == "installer"
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if remaining := time.Until(s.lockedUntil); remaining > 0 {
+		secs := int((remaining + time.Second - 1) / time.Second)
+		return errorBody(http.StatusTooManyRequests, "Too Many Requests", fmt.Sprintf("Your account has been locked for %d seconds due to too many failed login attempts", secs))
+	}
+	if req.Email != s.email || req.Password != s.password {
+		s.failedLogins++
+		if s.lockoutAfter > 0 && s.failedLogins >= s.lockoutAfter {
+			s.failedLogins = 0
+			s.lockedUntil = time.Now().Add(s.lockoutPeriod)
+		}
+		return errorBody(http.StatusUnauthorized, "bad credentials", "Login Error")
+	}
+	s.failedLogins = 0
+	token := newToken()
+	s.tokens[token] = issuedToken{issued: time.Now(), installer: installer}
+	if installer && req.ForceSmOff {
+		s.updateSitemaster(powerwall.SitemasterStatusDown, false)
+	}
+	role := powerwall.RoleHomeOwner
+	if installer {
+		role = powerwall.RoleProviderEngineer
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"email":     req.Email,
+		"firstname": "Tesla",
+		"lastname":  "Energy",
+		"roles":     []string{role},
+		"token":     token,
+		"provider":  "Basic",
+		"loginTime": time.Now().Format(time.RFC3339Nano),
+	})
+	return http.StatusOK, resp
+}
+
+func (s *Server) postOperation(body []byte) (int, []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	op := powerwall.OperationData{}
+	if err := json.Unmarshal(s.fixtures["operation"], &op); err != nil {
+		return errorBody(http.StatusInternalServerError, "internal error", err.Error())
+	}
+	if err := json.Unmarshal(body, &op); err != nil {
+		return errorBody(http.StatusBadRequest, "bad request", err.Error())
+	}
+	resp, _ := json.Marshal(op)
+	s.fixtures["operation"] = resp
+	return http.StatusOK, resp
+}
+
+func (s *Server) setSitemasterStatus(status string, running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.updateSitemaster(status, running)
+}
+
+// updateSitemaster is the same as setSitemasterStatus, but must be called
+// with the mutex held.
+func (s *Server) updateSitemaster(status string, running bool) {
+	sm := powerwall.SitemasterData{}
+	_ = json.Unmarshal(s.fixtures["sitemaster"], &sm)
+	sm.Status = status
+	sm.Running = running
+	s.fixtures["sitemaster"], _ = json.Marshal(sm)
+}
+
+func newToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("unable to generate token: %s", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+func errorBody(status int, errText string, message string) (int, []byte) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"code":    status,
+		"error":   errText,
+		"message": message,
+	})
+	return status, body
+}
+
+func writeError(w http.ResponseWriter, status int, errText string, message string) {
+	status, body := errorBody(status, errText, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// dropConnection closes the underlying connection without sending a response.
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// This shouldn't happen (we don't enable HTTP/2), but just in
+		// case, this is the next best thing.
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
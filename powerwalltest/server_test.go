@@ -0,0 +1,204 @@
+package powerwalltest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func newTestServer(t *testing.T) (*powerwalltest.Server, *powerwall.Client) {
+	s := powerwalltest.NewServer()
+	t.Cleanup(s.Close)
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+// apis returns the API of each of the recorded requests, in order.
+func apis(requests []powerwalltest.Request) string {
+	result := []string{}
+	for _, r := range requests {
+		result = append(result, r.API)
+	}
+	return strings.Join(result, ",")
+}
+
+func TestServerLogin(t *testing.T) {
+	s, client := newTestServer(t)
+
+	soe, err := client.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage == 0 {
+		t.Errorf("unexpected SOE %+v", soe)
+	}
+	reqs := s.Requests()
+	if apis(reqs) != "login/Basic,system_status/soe" {
+		t.Fatalf("unexpected requests: %s", apis(reqs))
+	}
+	if !strings.Contains(string(reqs[0].Body), powerwalltest.DefaultPassword) {
+		t.Errorf("login request body not recorded: %q", reqs[0].Body)
+	}
+	if reqs[1].Token == "" || !reqs[1].Authenticated || reqs[1].Token != client.GetAuthToken() {
+		t.Errorf("request was not made with the issued token: %+v", reqs[1])
+	}
+
+	// Once the token expires, the client should get a 401, log in again,
+	// and retry.
+	s.ExpireTokens()
+	s.ResetRequests()
+	if _, err := client.GetSOE(); err != nil {
+		t.Fatal(err)
+	}
+	reqs = s.Requests()
+	if apis(reqs) != "system_status/soe,login/Basic,system_status/soe" {
+		t.Fatalf("unexpected requests after expiring tokens: %s", apis(reqs))
+	}
+	if reqs[0].Authenticated || !reqs[2].Authenticated || reqs[0].Token == reqs[2].Token {
+		t.Errorf("expected an expired token and then a new one: %+v", reqs)
+	}
+
+	// The same should happen when tokens expire on their own.
+	s.SetTokenLifetime(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	s.ResetRequests()
+	if _, err := client.GetSOE(); err != nil {
+		t.Fatal(err)
+	}
+	if apis(s.Requests()) != "system_status/soe,login/Basic,system_status/soe" {
+		t.Errorf("unexpected requests after token lifetime: %s", apis(s.Requests()))
+	}
+}
+
+func TestServerBadLogin(t *testing.T) {
+	s, client := newTestServer(t)
+	s.SetLogin(powerwalltest.DefaultEmail, "something else")
+
+	_, err := client.GetSOE()
+	var authErr powerwall.AuthFailure
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected AuthFailure, got %v", err)
+	}
+	// Public APIs should still work.
+	if _, err := client.GetStatus(); err != nil {
+		t.Errorf("public API failed without login: %v", err)
+	}
+}
+
+func TestServerFixtures(t *testing.T) {
+	s, client := newTestServer(t)
+
+	if err := s.SetFixture("system_status/soe", powerwall.SOEData{Percentage: 42}); err != nil {
+		t.Fatal(err)
+	}
+	soe, err := client.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if soe.Percentage != 42 {
+		t.Errorf("fixture not returned: %+v", soe)
+	}
+
+	s.SetFixture("system_status/soe", []byte(`{"percentage": 12.5}`))
+	if soe, err = client.GetSOE(); err != nil || soe.Percentage != 12.5 {
+		t.Errorf("raw fixture not returned: %+v, %v", soe, err)
+	}
+
+	s.RemoveFixture("system_status/soe")
+	_, err = client.GetSOE()
+	var apiErr powerwall.ApiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 for a removed fixture, got %v", err)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s, client := newTestServer(t)
+	if err := client.DoLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A counted fault only applies to that many requests.
+	s.SetFault("system_status/soe", powerwalltest.Fault{StatusCode: http.StatusServiceUnavailable, Count: 2})
+	for i := 0; i < 2; i++ {
+		_, err := client.GetSOE()
+		var apiErr powerwall.ApiError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("request %d: expected a 503, got %v", i, err)
+		}
+	}
+	if _, err := client.GetSOE(); err != nil {
+		t.Errorf("fault was not removed after its count: %v", err)
+	}
+
+	s.SetFault("system_status/soe", powerwalltest.Fault{Malformed: true})
+	if _, err := client.GetSOE(); err == nil {
+		t.Errorf("expected an error for a malformed response")
+	}
+
+	s.SetFault("system_status/soe", powerwalltest.Fault{Drop: true})
+	if _, err := client.GetSOE(); err == nil {
+		t.Errorf("expected an error for a dropped connection")
+	}
+
+	// A specific fault overrides a "*" one.
+	s.ClearFaults()
+	s.SetFault("*", powerwalltest.Fault{StatusCode: http.StatusInternalServerError})
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err := client.GetSOE(); err != nil {
+		t.Errorf("request with latency failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("latency was not applied (took %s)", elapsed)
+	}
+	if _, err := client.GetGridStatus(); err == nil {
+		t.Errorf("\"*\" fault was not applied")
+	}
+
+	// Latency is cut short if the client gives up.
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 5 * time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetSOEContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	s.ClearFaults()
+	if _, err := client.GetGridStatus(); err != nil {
+		t.Errorf("faults were not cleared: %v", err)
+	}
+}
+
+func TestServerRequests(t *testing.T) {
+	s, client := newTestServer(t)
+	if _, err := client.SetOperation(powerwall.OperationModeSelf, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	var post *powerwalltest.Request
+	reqs := s.Requests()
+	for i := range reqs {
+		if reqs[i].API == "operation" && reqs[i].Method == http.MethodPost {
+			post = &reqs[i]
+		}
+	}
+	if post == nil {
+		t.Fatalf("operation POST not recorded: %s", apis(reqs))
+	}
+	if !strings.Contains(string(post.Body), `"backup_reserve_percent":30`) || post.Time.IsZero() {
+		t.Errorf("unexpected recorded request: %+v (body %s)", post, post.Body)
+	}
+
+	s.ResetRequests()
+	if reqs := s.Requests(); len(reqs) != 0 {
+		t.Errorf("requests not reset: %s", apis(reqs))
+	}
+}
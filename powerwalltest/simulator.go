@@ -0,0 +1,399 @@
+package powerwalltest
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// Profile returns the power (in watts) drawn by a load, or produced by a
+// generation source, at a given time.
+type Profile func(t time.Time) float32
+
+// ConstantProfile returns a Profile which is always the same number of watts.
+func ConstantProfile(watts float32) Profile {
+	return func(t time.Time) float32 {
+		return watts
+	}
+}
+
+// HouseLoadProfile returns a Profile for a typical house, which uses baseWatts
+// all the time, rising to peakWatts in the morning (around 7am) and evening
+// (around 7pm).
+func HouseLoadProfile(baseWatts float32, peakWatts float32) Profile {
+	return func(t time.Time) float32 {
+		hour := hourOfDay(t)
+		bump := math.Max(gaussian(hour, 7, 1.5), gaussian(hour, 19, 2))
+		return baseWatts + (peakWatts-baseWatts)*float32(bump)
+	}
+}
+
+// SolarProfile returns a Profile for solar panels which produce nothing at
+// night, rising along a sine curve from sunrise (6am) to peakWatts at noon,
+// and back down to nothing at sunset (6pm).
+func SolarProfile(peakWatts float32) Profile {
+	return func(t time.Time) float32 {
+		hour := hourOfDay(t)
+		if hour <= 6 || hour >= 18 {
+			return 0
+		}
+		return peakWatts * float32(math.Sin(math.Pi*(hour-6)/12))
+	}
+}
+
+func hourOfDay(t time.Time) float64 {
+	h, m, s := t.Clock()
+	return float64(h) + float64(m)/60 + float64(s)/3600
+}
+
+func gaussian(x float64, center float64, width float64) float64 {
+	d := (x - center) / width
+	return math.Exp(-d * d / 2)
+}
+
+// SimConfig contains settings for a Simulator.
+type SimConfig struct {
+	// Start is the simulated time the simulation starts at.  If zero,
+	// midnight UTC on 2022-06-21 is used.
+	Start time.Time
+	// Step is the length of each simulation step.  Longer steps are
+	// faster to simulate, but less accurate.  If zero, one minute is
+	// used.
+	Step time.Duration
+	// Load is the power used by the house.
+	Load Profile
+	// Solar is the power produced by solar panels (nil means there is no
+	// solar).
+	Solar Profile
+	// InitialSOE is the state of energy (percent) the battery starts at.
+	InitialSOE float32
+	// Capacity is the battery capacity, in Wh.  If zero, the
+	// NominalFullPackEnergy from the "system_status" fixture is used.
+	Capacity float32
+	// MaxChargePower and MaxDischargePower are the battery's power limits,
+	// in watts.  If zero, the MaxChargePower and MaxDischargePower from
+	// the "system_status" fixture are used.
+	MaxChargePower    float32
+	MaxDischargePower float32
+	// GridTransitionTime is how long (in simulated time) the system stays
+	// in GridStatusTransition after an outage ends before it is connected
+	// to the grid again.
+	GridTransitionTime time.Duration
+}
+
+// DefaultSimConfig contains reasonable defaults for a SimConfig.
+var DefaultSimConfig = SimConfig{
+	Step:               time.Minute,
+	Load:               HouseLoadProfile(500, 3000),
+	Solar:              SolarProfile(5000),
+	InitialSOE:         75,
+	GridTransitionTime: 30 * time.Second,
+}
+
+// SimState is the state of a Simulator as of the end of the most recent
+// simulation step.  Power values are in watts, using the same sign
+// conventions as the "meters/aggregates" API (site power is positive when
+// importing from the grid, battery power is positive when discharging).
+type SimState struct {
+	Time         time.Time
+	GridStatus   string
+	Energy       float32 // Wh remaining in the battery
+	SOE          float32
+	LoadPower    float32
+	SolarPower   float32
+	BatteryPower float32
+	SitePower    float32
+}
+
+// simMeter tracks the cumulative energy counters (in Wh) for one meter.
+type simMeter struct {
+	exported float64
+	imported float64
+}
+
+// Simulator is a Server whose responses are produced by a simple model of a
+// house with solar panels and a Powerwall, instead of static fixtures.  The
+// "system_status/soe", "system_status/grid_status", "system_status", and
+// "meters/aggregates" responses (including the energy imported/exported
+// counters) are updated as the simulation advances, so that they stay
+// consistent with each other.
+//
+// Simulated time does not pass on its own.  It only advances when Advance is
+// called, which makes it possible to simulate days of operation in a test
+// which takes milliseconds.
+//
+// The battery is operated as if in "self powered" mode: excess solar is used
+// to charge it, and it discharges to cover any shortfall until it reaches the
+// backup reserve (taken from the "operation" fixture, so changing it with
+// SetOperation has the expected effect).  During a grid outage, it will
+// discharge below the backup reserve if needed, excess solar which cannot be
+// stored is curtailed, and load which cannot be supported is shed.
+type Simulator struct {
+	*Server
+
+	mutex      sync.Mutex
+	config     SimConfig
+	state      SimState
+	outage     bool
+	transitEnd time.Time
+	meters     map[string]*simMeter
+}
+
+// NewSimulator creates and starts a new Simulator using the provided config.
+// The caller should call Close when finished with it.
+func NewSimulator(config SimConfig) *Simulator {
+	sim := &Simulator{
+		Server: NewServer(),
+		config: config,
+		meters: map[string]*simMeter{
+			"site":    {},
+			"battery": {},
+			"load":    {},
+			"solar":   {},
+		},
+	}
+	if sim.config.Start.IsZero() {
+		sim.config.Start = time.Date(2022, 6, 21, 0, 0, 0, 0, time.UTC)
+	}
+	if sim.config.Step <= 0 {
+		sim.config.Step = time.Minute
+	}
+	if sim.config.Load == nil {
+		sim.config.Load = ConstantProfile(0)
+	}
+	if sim.config.Solar == nil {
+		sim.config.Solar = ConstantProfile(0)
+	}
+
+	status := powerwall.SystemStatusData{}
+	sim.Server.mutex.Lock()
+	_ = json.Unmarshal(sim.fixtures["system_status"], &status)
+	sim.Server.mutex.Unlock()
+	if sim.config.Capacity <= 0 {
+		sim.config.Capacity = status.NominalFullPackEnergy
+	}
+	if sim.config.MaxChargePower <= 0 {
+		sim.config.MaxChargePower = status.MaxChargePower
+	}
+	if sim.config.MaxDischargePower <= 0 {
+		sim.config.MaxDischargePower = status.MaxDischargePower
+	}
+
+	sim.state = SimState{
+		Time:       sim.config.Start,
+		GridStatus: powerwall.GridStatusConnected,
+		Energy:     sim.config.Capacity * sim.config.InitialSOE / 100,
+		SOE:        sim.config.InitialSOE,
+	}
+	sim.updateFixtures()
+	return sim
+}
+
+// State returns the current state of the simulation.
+func (sim *Simulator) State() SimState {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return sim.state
+}
+
+// Now returns the current simulated time.
+func (sim *Simulator) Now() time.Time {
+	return sim.State().Time
+}
+
+// Advance runs the simulation forward by the specified amount of simulated
+// time.
+func (sim *Simulator) Advance(d time.Duration) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	for d > 0 {
+		dt := sim.config.Step
+		if dt > d {
+			dt = d
+		}
+		sim.step(dt)
+		d -= dt
+	}
+	sim.updateFixtures()
+}
+
+// StartOutage simulates the utility power going out.  The system goes
+// off-grid immediately.
+func (sim *Simulator) StartOutage() {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	sim.outage = true
+	sim.state.GridStatus = powerwall.GridStatusIslanded
+	sim.updateFixtures()
+}
+
+// EndOutage simulates the utility power coming back.  The system will be in
+// GridStatusTransition for the configured GridTransitionTime (of simulated
+// time) before it is connected to the grid again.
+func (sim *Simulator) EndOutage() {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	if !sim.outage {
+		return
+	}
+	sim.outage = false
+	if sim.config.GridTransitionTime > 0 {
+		sim.state.GridStatus = powerwall.GridStatusTransition
+		sim.transitEnd = sim.state.Time.Add(sim.config.GridTransitionTime)
+	} else {
+		sim.state.GridStatus = powerwall.GridStatusConnected
+	}
+	sim.updateFixtures()
+}
+
+// backupReserve returns the backup reserve (in Wh) from the "operation"
+// fixture.
+func (sim *Simulator) backupReserve() float32 {
+	op := powerwall.OperationData{}
+	sim.Server.mutex.Lock()
+	_ = json.Unmarshal(sim.fixtures["operation"], &op)
+	sim.Server.mutex.Unlock()
+	return sim.config.Capacity * op.BackupReservePercent / 100
+}
+
+// step runs one simulation step of length dt.  (This must be called with the
+// simulator's mutex held.)
+func (sim *Simulator) step(dt time.Duration) {
+	st := &sim.state
+	cfg := &sim.config
+	hours := float32(dt.Hours())
+
+	// The system stays off-grid until the transition is complete.
+	offGrid := st.GridStatus != powerwall.GridStatusConnected
+
+	load := cfg.Load(st.Time)
+	solar := cfg.Solar(st.Time)
+	room := (cfg.Capacity - st.Energy) / hours
+	floor := sim.backupReserve()
+	if offGrid {
+		floor = 0
+	}
+	available := float32(math.Max(0, float64((st.Energy-floor)/hours)))
+
+	var battery float32
+	if solar > load {
+		battery = -minFloat(solar-load, cfg.MaxChargePower, room)
+	} else {
+		battery = minFloat(load-solar, cfg.MaxDischargePower, available)
+	}
+	site := load - solar - battery
+	if offGrid {
+		// There's nowhere for the difference to go, so curtail solar or
+		// shed load to make things balance.
+		if site < 0 {
+			solar += site
+		} else {
+			load -= site
+		}
+		site = 0
+	}
+
+	st.Energy -= battery * hours
+	st.Energy = float32(math.Max(0, math.Min(float64(cfg.Capacity), float64(st.Energy))))
+	st.SOE = 100 * st.Energy / cfg.Capacity
+	st.LoadPower = load
+	st.SolarPower = solar
+	st.BatteryPower = battery
+	st.SitePower = site
+	st.Time = st.Time.Add(dt)
+	if st.GridStatus == powerwall.GridStatusTransition && !st.Time.Before(sim.transitEnd) {
+		st.GridStatus = powerwall.GridStatusConnected
+	}
+
+	sim.meters["site"].add(site, hours)
+	sim.meters["battery"].add(battery, hours)
+	sim.meters["solar"].add(solar, hours)
+	sim.meters["load"].add(-load, hours)
+}
+
+// add accumulates the energy counters for the given power (positive means
+// energy is leaving the meter's device) over the given number of hours.
+func (m *simMeter) add(power float32, hours float32) {
+	if power > 0 {
+		m.exported += float64(power * hours)
+	} else {
+		m.imported += float64(-power * hours)
+	}
+}
+
+func minFloat(values ...float32) float32 {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+// updateFixtures updates the server's fixtures to reflect the current state.
+// (This must be called with the simulator's mutex held.)
+func (sim *Simulator) updateFixtures() {
+	const voltage = 240
+	st := sim.state
+
+	aggregates := map[string]powerwall.MeterAggregatesData{}
+	powers := map[string]float32{
+		"site":    st.SitePower,
+		"battery": st.BatteryPower,
+		"load":    st.LoadPower,
+		"solar":   st.SolarPower,
+	}
+	for name, power := range powers {
+		m := sim.meters[name]
+		// The site meter reports energy from the grid's point of view
+		// (imported means we took it from the grid), and the load
+		// meter reports consumption as imported.
+		exported, imported := m.exported, m.imported
+		if name == "site" {
+			exported, imported = imported, exported
+		}
+		aggregates[name] = powerwall.MeterAggregatesData{
+			LastCommunicationTime: st.Time,
+			InstantPower:          power,
+			InstantApparentPower:  float32(math.Abs(float64(power))),
+			Frequency:             60,
+			EnergyExported:        float32(exported),
+			EnergyImported:        float32(imported),
+			InstantAverageVoltage: voltage,
+			InstantAverageCurrent: power / voltage,
+			InstantTotalCurrent:   power / voltage,
+			Timeout:               1500000000,
+			NumMetersAggregated:   1,
+		}
+	}
+
+	s := sim.Server
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fixtures["meters/aggregates"], _ = json.Marshal(aggregates)
+	s.fixtures["system_status/soe"], _ = json.Marshal(powerwall.SOEData{Percentage: st.SOE})
+	s.fixtures["system_status/grid_status"], _ = json.Marshal(powerwall.GridStatusData{GridStatus: st.GridStatus})
+	s.patchFixture("system_status", map[string]interface{}{
+		"nominal_full_pack_energy": sim.config.Capacity,
+		"nominal_energy_remaining": st.Energy,
+		"max_charge_power":         sim.config.MaxChargePower,
+		"max_discharge_power":      sim.config.MaxDischargePower,
+		"system_island_state":      st.GridStatus,
+	})
+}
+
+// patchFixture replaces the specified top-level fields of a fixture which is a
+// JSON object, leaving the rest of it as-is.  (This must be called with the
+// mutex held.)
+func (s *Server) patchFixture(api string, fields map[string]interface{}) {
+	obj := map[string]interface{}{}
+	_ = json.Unmarshal(s.fixtures[api], &obj)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	s.fixtures[api], _ = json.Marshal(obj)
+}
@@ -0,0 +1,137 @@
+package powerwalltest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func newTestSimulator(t *testing.T, config powerwalltest.SimConfig) (*powerwalltest.Simulator, *powerwall.Client) {
+	sim := powerwalltest.NewSimulator(config)
+	t.Cleanup(sim.Close)
+	client := sim.NewClient(powerwall.WithLogger(t.Log))
+	t.Cleanup(func() { client.Close() })
+	return sim, client
+}
+
+func getSOE(t *testing.T, client *powerwall.Client) float32 {
+	t.Helper()
+	soe, err := client.GetSOE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return soe.Percentage
+}
+
+func getMeters(t *testing.T, client *powerwall.Client) map[string]powerwall.MeterAggregatesData {
+	t.Helper()
+	meters, err := client.GetMetersAggregates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *meters
+}
+
+func TestSimulatorDay(t *testing.T) {
+	sim, client := newTestSimulator(t, powerwalltest.DefaultSimConfig)
+
+	if soe := getSOE(t, client); soe != powerwalltest.DefaultSimConfig.InitialSOE {
+		t.Errorf("expected initial SOE of %v, got %v", powerwalltest.DefaultSimConfig.InitialSOE, soe)
+	}
+
+	// Overnight, the house runs from the battery.
+	sim.Advance(6 * time.Hour)
+	if sim.Now() != time.Date(2022, 6, 21, 6, 0, 0, 0, time.UTC) {
+		t.Errorf("unexpected simulated time %s", sim.Now())
+	}
+	morning := getSOE(t, client)
+	if morning >= powerwalltest.DefaultSimConfig.InitialSOE {
+		t.Errorf("SOE did not drop overnight (%v)", morning)
+	}
+	meters := getMeters(t, client)
+	if meters["battery"].EnergyExported <= 0 || meters["load"].EnergyImported <= 0 {
+		t.Errorf("energy counters did not advance overnight: %+v", meters)
+	}
+	if meters["solar"].InstantPower != 0 {
+		t.Errorf("solar power before sunrise: %v", meters["solar"].InstantPower)
+	}
+	// The battery should not have gone below the backup reserve.
+	op, err := client.GetOperation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if morning < op.BackupReservePercent-0.1 {
+		t.Errorf("SOE %v is below the backup reserve %v", morning, op.BackupReservePercent)
+	}
+
+	// During the day, solar charges it back up.
+	sim.Advance(6 * time.Hour)
+	noon := getSOE(t, client)
+	if noon <= morning {
+		t.Errorf("SOE did not rise during the day (%v -> %v)", morning, noon)
+	}
+	later := getMeters(t, client)
+	if later["solar"].InstantPower <= 0 || later["solar"].EnergyExported <= meters["solar"].EnergyExported {
+		t.Errorf("no solar production at noon: %+v", later["solar"])
+	}
+	if later["battery"].EnergyImported <= meters["battery"].EnergyImported {
+		t.Errorf("battery charge counter did not advance: %+v", later["battery"])
+	}
+
+	// The fixtures should be consistent with each other, and with
+	// State().
+	state := sim.State()
+	status, err := client.GetSystemStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NominalEnergyRemaining != state.Energy || state.SOE != noon {
+		t.Errorf("system_status (%v Wh) and soe (%v%%) do not match state %+v", status.NominalEnergyRemaining, noon, state)
+	}
+}
+
+func TestSimulatorOutage(t *testing.T) {
+	config := powerwalltest.DefaultSimConfig
+	config.Solar = nil
+	config.Load = powerwalltest.ConstantProfile(2000)
+	sim, client := newTestSimulator(t, config)
+
+	gridStatus := func() string {
+		t.Helper()
+		gs, err := client.GetGridStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gs.GridStatus
+	}
+
+	sim.StartOutage()
+	if status := gridStatus(); status != powerwall.GridStatusIslanded {
+		t.Errorf("expected islanded, got %s", status)
+	}
+	// Off-grid, the battery can discharge below the reserve, and nothing
+	// comes from the grid.
+	sim.Advance(5 * time.Hour)
+	meters := getMeters(t, client)
+	if meters["site"].InstantPower != 0 {
+		t.Errorf("site power during outage: %v", meters["site"].InstantPower)
+	}
+	if soe := getSOE(t, client); soe >= 20 {
+		t.Errorf("SOE did not drop below the reserve during the outage (%v)", soe)
+	}
+
+	sim.EndOutage()
+	if status := gridStatus(); status != powerwall.GridStatusTransition {
+		t.Errorf("expected transition, got %s", status)
+	}
+	sim.Advance(time.Minute)
+	if status := gridStatus(); status != powerwall.GridStatusConnected {
+		t.Errorf("expected connected, got %s", status)
+	}
+	sim.Advance(time.Minute)
+	if power := getMeters(t, client)["site"].InstantPower; power <= 0 {
+		t.Errorf("not importing from the grid after the outage (%v)", power)
+	}
+}
@@ -0,0 +1,230 @@
+package powerwall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Some newer parts of the gateway API (such as "devices/vitals") return data
+// in protobuf format instead of JSON.  Rather than pull in a full protobuf
+// library (and generated code) just for these few messages, we implement the
+// (quite simple) protobuf wire format directly here, and decode the messages
+// by hand.  See the .proto files in this package for the message definitions
+// as we currently understand them.
+
+// Protobuf wire types
+const (
+	pbWireVarint  = 0
+	pbWireFixed64 = 1
+	pbWireBytes   = 2
+	pbWireFixed32 = 5
+)
+
+var errPbTruncated = errors.New("protobuf: message truncated")
+
+// pbField represents a single decoded field from a protobuf message.
+// Depending on the wire type, the value will be in either the "varint" field
+// (for varint, fixed32, and fixed64 types) or the "bytes" field (for
+// length-delimited types: strings, bytes, and embedded messages).
+type pbField struct {
+	num      int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+func (f pbField) String() string {
+	return string(f.bytes)
+}
+
+func (f pbField) Int() int64 {
+	return int64(f.varint)
+}
+
+func (f pbField) Bool() bool {
+	return f.varint != 0
+}
+
+// Float returns the value of a fixed32 (float) or fixed64 (double) field.
+func (f pbField) Float() float64 {
+	if f.wireType == pbWireFixed32 {
+		return float64(math.Float32frombits(uint32(f.varint)))
+	}
+	return math.Float64frombits(f.varint)
+}
+
+func pbReadVarint(data []byte) (uint64, int, error) {
+	v, n := binary.Uvarint(data)
+	if n == 0 {
+		return 0, 0, errPbTruncated
+	} else if n < 0 {
+		return 0, 0, errors.New("protobuf: varint overflow")
+	}
+	return v, n, nil
+}
+
+// pbParse decodes all of the top-level fields of a protobuf message, in the
+// order in which they appear.
+func pbParse(data []byte) ([]pbField, error) {
+	fields := []pbField{}
+	for len(data) > 0 {
+		key, n, err := pbReadVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		f := pbField{num: int(key >> 3), wireType: int(key & 7)}
+		switch f.wireType {
+		case pbWireVarint:
+			f.varint, n, err = pbReadVarint(data)
+			if err != nil {
+				return nil, err
+			}
+		case pbWireFixed64:
+			if len(data) < 8 {
+				return nil, errPbTruncated
+			}
+			f.varint = binary.LittleEndian.Uint64(data)
+			n = 8
+		case pbWireFixed32:
+			if len(data) < 4 {
+				return nil, errPbTruncated
+			}
+			f.varint = uint64(binary.LittleEndian.Uint32(data))
+			n = 4
+		case pbWireBytes:
+			var length uint64
+			length, n, err = pbReadVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(data)-n) < length {
+				return nil, errPbTruncated
+			}
+			f.bytes = data[n : n+int(length)]
+			n += int(length)
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported wire type %d (field %d)", f.wireType, f.num)
+		}
+		data = data[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// pbFind returns the (first) length-delimited field with the specified field
+// number, or nil if it's not present.
+func pbFind(fields []pbField, num int) *pbField {
+	for i := range fields {
+		if fields[i].num == num && fields[i].wireType == pbWireBytes {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// pbFindPath follows a path of nested message fields and returns the final
+// field found (or nil, if any part of the path is missing).
+func pbFindPath(fields []pbField, path ...int) (*pbField, error) {
+	var f *pbField
+	for i, num := range path {
+		f = pbFind(fields, num)
+		if f == nil {
+			return nil, nil
+		}
+		if i < len(path)-1 {
+			var err error
+			fields, err = pbParse(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// pbWrappedString decodes a google.protobuf.StringValue message, which just
+// contains a single string in field 1.
+func pbWrappedString(data []byte) (string, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fields {
+		if f.num == 1 && f.wireType == pbWireBytes {
+			return f.String(), nil
+		}
+	}
+	return "", nil
+}
+
+// pbTimestamp decodes a google.protobuf.Timestamp message.
+func pbTimestamp(data []byte) (time.Time, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var seconds, nanos int64
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			seconds = f.Int()
+		case 2:
+			nanos = f.Int()
+		}
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+func pbAppendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// pbWriter is used to build protobuf-encoded messages.
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) Bytes() []byte {
+	return w.buf
+}
+
+func (w *pbWriter) key(num int, wireType int) {
+	w.buf = pbAppendVarint(w.buf, uint64(num)<<3|uint64(wireType))
+}
+
+func (w *pbWriter) Varint(num int, v uint64) {
+	w.key(num, pbWireVarint)
+	w.buf = pbAppendVarint(w.buf, v)
+}
+
+func (w *pbWriter) Bool(num int, v bool) {
+	if v {
+		w.Varint(num, 1)
+	} else {
+		w.Varint(num, 0)
+	}
+}
+
+func (w *pbWriter) RawBytes(num int, v []byte) {
+	w.key(num, pbWireBytes)
+	w.buf = pbAppendVarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *pbWriter) String(num int, v string) {
+	w.RawBytes(num, []byte(v))
+}
+
+// Message encodes an embedded message, using the provided function to write
+// its contents.
+func (w *pbWriter) Message(num int, f func(*pbWriter)) {
+	sub := &pbWriter{}
+	f(sub)
+	w.RawBytes(num, sub.Bytes())
+}
@@ -0,0 +1,406 @@
+// Functions for detecting changes in the gateway's API responses:
+//
+// (Note: Schema checking is enabled using the WithSchemaCheck option)
+//
+package powerwall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SchemaDriftKind identifies the type of a SchemaDrift.
+type SchemaDriftKind string
+
+// Kinds of differences which can be reported in a SchemaDrift:
+const (
+	// The gateway returned a field which the library does not know about.
+	// (Its value can be found in the Extra field of the returned struct.)
+	SchemaFieldAdded SchemaDriftKind = "added"
+	// The gateway did not return a field which the library expected.
+	SchemaFieldMissing SchemaDriftKind = "missing"
+	// The gateway returned a field with a different JSON type than the
+	// library expected (this will usually also cause the call to fail).
+	SchemaFieldTypeChanged SchemaDriftKind = "type_changed"
+	// The gateway returned a value for a field whose type is not yet known
+	// to the library (one of the interface{} fields).  The Actual field
+	// says what type it turned out to be.
+	SchemaFieldUntyped SchemaDriftKind = "untyped"
+)
+
+// SchemaDrift describes a difference between a response returned by the
+// gateway and what the library expected it to contain.  These are reported
+// by clients which have been created with the WithSchemaCheck option.
+type SchemaDrift struct {
+	Kind SchemaDriftKind
+	// API is the API call which returned the response (e.g.
+	// "system_status").
+	API string
+	// Version is the gateway firmware version, as reported by the "status"
+	// API call (or empty, if it could not be determined).
+	Version string
+	// Field is the path to the field within the response, using JSON names
+	// (e.g. "battery_blocks[].p_out").  Map keys and array indexes are
+	// written as "[]".
+	Field string
+	// Expected and Actual are the JSON types ("string", "number", "bool",
+	// "object", "array", or "null") the field was expected to have and
+	// actually had.  (Not all of these are meaningful for all kinds of
+	// drift.)
+	Expected string
+	Actual   string
+}
+
+func (d SchemaDrift) Error() string {
+	msg := fmt.Sprintf("API schema drift in '%s' (firmware %q): field %q %s", d.API, d.Version, d.Field, d.Kind)
+	switch d.Kind {
+	case SchemaFieldAdded, SchemaFieldUntyped:
+		msg += fmt.Sprintf(" (type %s)", d.Actual)
+	case SchemaFieldTypeChanged:
+		msg += fmt.Sprintf(" (expected %s, got %s)", d.Expected, d.Actual)
+	}
+	return msg
+}
+
+// schemaState keeps track of the information needed for schema checking.
+type schemaState struct {
+	mutex    sync.Mutex
+	version  string
+	reported map[SchemaDrift]bool
+}
+
+// checkSchema compares a JSON response with the struct it was unmarshalled
+// into, fills in any Extra fields, and reports any differences.  (This does
+// nothing unless schema checking has been enabled for the client.)
+func (c *Client) checkSchema(ctx context.Context, api string, data []byte, result interface{}) {
+	if !c.schemaCheck {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		// Not valid JSON at all.  The caller will already be
+		// reporting that as an error.
+		return
+	}
+
+	w := schemaWalker{}
+	w.walk("", raw, reflect.ValueOf(result))
+	if len(w.diffs) == 0 {
+		return
+	}
+
+	version := c.firmwareVersion(ctx, api, raw)
+	c.schema.mutex.Lock()
+	defer c.schema.mutex.Unlock()
+	for _, diff := range w.diffs {
+		d := diff.SchemaDrift
+		d.API = api
+		d.Version = version
+		if c.schema.reported[d] {
+			continue
+		}
+		c.schema.reported[d] = true
+		c.logf("%s", d)
+		if c.schemaFunc != nil {
+			c.schemaFunc(d)
+		} else {
+			errFunc(d.Error(), d)
+		}
+	}
+}
+
+// firmwareVersion returns the gateway's firmware version, fetching it from
+// the "status" API if it is not already known.
+func (c *Client) firmwareVersion(ctx context.Context, api string, raw interface{}) string {
+	c.schema.mutex.Lock()
+	version := c.schema.version
+	c.schema.mutex.Unlock()
+
+	if api == "status" {
+		if obj, ok := raw.(map[string]interface{}); ok {
+			version, _ = obj["version"].(string)
+		}
+	} else if version == "" {
+		status := struct {
+			Version string `json:"version"`
+		}{}
+		data, err := c.doHttpRequest(ctx, "status", http.MethodGet, nil, "")
+		if err == nil {
+			_ = json.Unmarshal(data, &status)
+		}
+		version = status.Version
+	}
+
+	c.schema.mutex.Lock()
+	if version != "" {
+		c.schema.version = version
+	}
+	c.schema.mutex.Unlock()
+	return version
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// schemaDiff is a SchemaDrift, with some additional information used for
+// reporting decoding errors.
+type schemaDiff struct {
+	SchemaDrift
+	goType reflect.Type
+	value  interface{}
+}
+
+// schemaWalker walks a decoded JSON value alongside the Go value it was
+// unmarshalled into, and collects the differences between them.
+//
+// Any values in the JSON which cannot be unmarshalled into the corresponding
+// Go type are removed (or replaced with nil, in lists) as it goes, so that
+// afterwards the JSON can be re-encoded and unmarshalled without errors.
+type schemaWalker struct {
+	diffs []schemaDiff
+}
+
+func (w *schemaWalker) report(kind SchemaDriftKind, path string, expected string, actual string, goType reflect.Type, value interface{}) {
+	w.diffs = append(w.diffs, schemaDiff{
+		SchemaDrift: SchemaDrift{
+			Kind:     kind,
+			Field:    strings.TrimPrefix(path, "."),
+			Expected: expected,
+			Actual:   actual,
+		},
+		goType: goType,
+		value:  value,
+	})
+}
+
+// walk compares raw with v, and returns true if raw is not a valid value for
+// v's type (and should therefore be replaced by the caller).
+func (w *schemaWalker) walk(path string, raw interface{}, v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			// Nothing was decoded here, but we can still check
+			// against the type.
+			v = reflect.New(v.Type().Elem())
+		}
+		v = v.Elem()
+	}
+	if raw == nil {
+		// null is acceptable for anything
+		return false
+	}
+	actual := jsonType(raw)
+	if reflect.PtrTo(v.Type()).Implements(jsonUnmarshalerType) {
+		// This type does its own parsing, so we can't really tell
+		// what it's expecting, but we can check whether it's happy.
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, reflect.New(v.Type()).Interface()); err != nil {
+			w.report(SchemaFieldTypeChanged, path, "", actual, v.Type(), raw)
+			return true
+		}
+		return false
+	}
+
+	expected := jsonKind(v.Type())
+	if expected != "" && expected != actual {
+		w.report(SchemaFieldTypeChanged, path, expected, actual, v.Type(), raw)
+		return true
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := raw.(json.Number).Int64()
+		if err != nil || v.OverflowInt(n) {
+			w.report(SchemaFieldTypeChanged, path, "integer", actual, v.Type(), raw)
+			return true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(string(raw.(json.Number)), 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			w.report(SchemaFieldTypeChanged, path, "integer", actual, v.Type(), raw)
+			return true
+		}
+	case reflect.Struct:
+		w.walkStruct(path, raw.(map[string]interface{}), v)
+	case reflect.Map:
+		rawMap := raw.(map[string]interface{})
+		for key, rawValue := range rawMap {
+			// Map values aren't addressable, so we need to work
+			// on a copy and then put it back.
+			elem := reflect.New(v.Type().Elem()).Elem()
+			mv := v.MapIndex(reflect.ValueOf(key))
+			if mv.IsValid() {
+				elem.Set(mv)
+			}
+			if w.walk(path+"[]", rawValue, elem) {
+				delete(rawMap, key)
+			} else if mv.IsValid() {
+				v.SetMapIndex(reflect.ValueOf(key), elem)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		rawList := raw.([]interface{})
+		for i := range rawList {
+			var elem reflect.Value
+			if i < v.Len() {
+				elem = v.Index(i)
+			} else {
+				elem = reflect.New(v.Type().Elem()).Elem()
+			}
+			if w.walk(path+"[]", rawList[i], elem) {
+				rawList[i] = nil
+			}
+		}
+	case reflect.Interface:
+		if !isEmptyJSON(raw) {
+			w.report(SchemaFieldUntyped, path, "", actual, v.Type(), raw)
+		}
+	}
+	return false
+}
+
+func (w *schemaWalker) walkStruct(path string, raw map[string]interface{}, v reflect.Value) {
+	type fieldInfo struct {
+		index     int
+		omitEmpty bool
+	}
+	fields := map[string]fieldInfo{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(sf.Tag.Get("json"), ",")
+		name := parts[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		info := fieldInfo{index: i}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				info.omitEmpty = true
+			}
+		}
+		fields[name] = info
+	}
+
+	// Sort the keys so that drifts are always reported in the same order.
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	extra := map[string]interface{}{}
+	matched := map[string]bool{}
+	for _, key := range keys {
+		info, ok := fields[key]
+		if !ok {
+			// encoding/json matches field names case-insensitively,
+			// so we need to as well.
+			for name, fi := range fields {
+				if strings.EqualFold(name, key) {
+					info, ok = fi, true
+					break
+				}
+			}
+		}
+		if !ok {
+			extra[key] = raw[key]
+			w.report(SchemaFieldAdded, path+"."+key, "", jsonType(raw[key]), nil, raw[key])
+			continue
+		}
+		matched[t.Field(info.index).Name] = true
+		if w.walk(path+"."+key, raw[key], v.Field(info.index)) {
+			delete(raw, key)
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := fields[name]
+		if !matched[t.Field(info.index).Name] && !info.omitEmpty {
+			w.report(SchemaFieldMissing, path+"."+name, jsonKind(t.Field(info.index).Type), "", t.Field(info.index).Type, nil)
+		}
+	}
+
+	if len(extra) > 0 {
+		f := v.FieldByName("Extra")
+		if f.IsValid() && f.CanSet() && f.Type() == reflect.TypeOf(extra) {
+			f.Set(reflect.ValueOf(extra))
+		}
+	}
+}
+
+// jsonKind returns the JSON type which is expected for a Go type (or "" if it
+// can be anything).
+func jsonKind(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return ""
+}
+
+// jsonType returns the type of a decoded JSON value.
+func jsonType(raw interface{}) string {
+	switch raw.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case json.Number, float64:
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", raw)
+}
+
+func isEmptyJSON(raw interface{}) bool {
+	switch v := raw.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
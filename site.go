@@ -1,11 +1,26 @@
 // Functions for getting general info about the gateway and site:
 //
 //   (*Client) GetStatus()
+//   (*Client) GetStatusContext(ctx)
 //   (*Client) GetSiteInfo()
+//   (*Client) GetSiteInfoContext(ctx)
 //   (*Client) GetSitemaster()
+//   (*Client) GetSitemasterContext(ctx)
+//   (*Client) StopSitemaster(force)
+//   (*Client) StopSitemasterContext(ctx, force)
+//   (*Client) StartSitemaster()
+//   (*Client) StartSitemasterContext(ctx)
 //
 package powerwall
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // StatusData contains general system information returned by the "status" API
@@ -25,6 +40,8 @@ type StatusData struct {
 	Leader           string      `json:"leader"`
 	Followers        interface{} `json:"followers"` // TODO: Unsure what type this returns when present
 	CellularDisabled bool        `json:"cellular_disabled"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetStatus performs a "status" API call to fetch basic information about the
@@ -35,8 +52,14 @@ type StatusData struct {
 //
 // See the StatusData type for more information on what fields this returns.
 func (c *Client) GetStatus() (*StatusData, error) {
+	return c.GetStatusContext(context.Background())
+}
+
+// GetStatusContext is the same as GetStatus, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetStatusContext(ctx context.Context) (*StatusData, error) {
 	result := StatusData{}
-	err := c.apiGetJson("status", &result)
+	err := c.apiGetJson(ctx, "status", &result)
 	return &result, err
 }
 
@@ -67,6 +90,8 @@ type SiteInfoData struct {
 		Retailer           string `json:"retailer"`
 		Region             string `json:"region"`
 	} `json:"grid_code"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetSiteInfo returns information about the "site".
@@ -75,9 +100,15 @@ type SiteInfoData struct {
 //
 // See the SiteInfoData type for more information on what fields this returns.
 func (c *Client) GetSiteInfo() (*SiteInfoData, error) {
-	c.checkLogin()
+	return c.GetSiteInfoContext(context.Background())
+}
+
+// GetSiteInfoContext is the same as GetSiteInfo, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetSiteInfoContext(ctx context.Context) (*SiteInfoData, error) {
+	c.checkLogin(ctx)
 	result := SiteInfoData{}
-	err := c.apiGetJson("site_info", &result)
+	err := c.apiGetJson(ctx, "site_info", &result)
 	return &result, err
 }
 
@@ -102,6 +133,8 @@ type SitemasterData struct {
 	ConnectedToTesla bool   `json:"connected_to_tesla"`
 	PowerSupplyMode  bool   `json:"power_supply_mode"`
 	CanReboot        string `json:"can_reboot"`
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // Possible values for the Status field of the SitemasterData struct:
@@ -125,8 +158,135 @@ const (
 //
 // See the SitemasterData type for more information on what fields this returns.
 func (c *Client) GetSitemaster() (*SitemasterData, error) {
-	c.checkLogin()
+	return c.GetSitemasterContext(context.Background())
+}
+
+// GetSitemasterContext is the same as GetSitemaster, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetSitemasterContext(ctx context.Context) (*SitemasterData, error) {
+	c.checkLogin(ctx)
 	result := SitemasterData{}
-	err := c.apiGetJson("sitemaster", &result)
+	err := c.apiGetJson(ctx, "sitemaster", &result)
 	return &result, err
 }
+
+// How often to check the sitemaster status when waiting for it to change.
+const sitemasterPollInterval = 1 * time.Second
+
+// StopSitemaster stops the sitemaster process.  This is necessary before
+// making many types of configuration changes.
+//
+// Before stopping, this checks the CanReboot field of the sitemaster status
+// to make sure it is safe to do so.  If it is not, a SitemasterCannotStop
+// error is returned, unless force is true, in which case the sitemaster will
+// be stopped anyway.  (Some firmware versions do not report CanReboot at all.
+// If it is empty, the check is skipped.)
+//
+// After issuing the stop command, this will wait until the sitemaster actually
+// reports that it is down (for up to the time set by WithSitemasterTimeout)
+// before returning.
+func (c *Client) StopSitemaster(force bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.sitemasterTimeout)
+	defer cancel()
+	return c.StopSitemasterContext(ctx, force)
+}
+
+// StopSitemasterContext is the same as StopSitemaster, but uses the provided
+// context to allow cancelling or setting a deadline on the operation (instead
+// of the client's sitemaster timeout).
+func (c *Client) StopSitemasterContext(ctx context.Context, force bool) error {
+	_, err := c.stopSitemaster(ctx, force)
+	return err
+}
+
+// stopSitemaster does the work of StopSitemasterContext.  It also returns
+// whether the stop request was actually sent to the gateway (even if it then
+// failed, since the gateway may have acted on it anyway), so that the caller
+// knows whether it may need to restart the sitemaster again afterwards.
+func (c *Client) stopSitemaster(ctx context.Context, force bool) (requested bool, err error) {
+	type stopRequest struct {
+		Force bool `json:"force"`
+	}
+
+	sm, err := c.GetSitemasterContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	if sm.Status == SitemasterStatusDown {
+		c.logf("Sitemaster is already stopped")
+		return false, nil
+	}
+	if sm.CanReboot == "" {
+		// Some firmware versions don't report this at all, in which
+		// case we have no way to tell, so we just have to go ahead.
+		c.logf("Sitemaster did not report whether it can be stopped.  Proceeding anyway.")
+	} else if sm.CanReboot != SitemasterRebootOK {
+		if !force {
+			return false, SitemasterCannotStop{Reason: sm.CanReboot}
+		}
+		c.logf("Forcing sitemaster stop (can_reboot=%s)", sm.CanReboot)
+	}
+
+	payload, err := json.Marshal(stopRequest{Force: force})
+	if err != nil {
+		return false, err
+	}
+	_, err = c.doHttpRequest(ctx, "sitemaster/stop", http.MethodPost, payload, "application/json")
+	if err != nil {
+		return true, err
+	}
+	return true, c.waitForSitemasterStatus(ctx, SitemasterStatusDown)
+}
+
+// StartSitemaster starts the sitemaster process (after it has been stopped
+// with StopSitemaster).  This will wait until the sitemaster actually reports
+// that it is up (for up to the time set by WithSitemasterTimeout) before
+// returning.
+func (c *Client) StartSitemaster() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.sitemasterTimeout)
+	defer cancel()
+	return c.StartSitemasterContext(ctx)
+}
+
+// StartSitemasterContext is the same as StartSitemaster, but uses the
+// provided context to allow cancelling or setting a deadline on the operation
+// (instead of the client's sitemaster timeout).
+func (c *Client) StartSitemasterContext(ctx context.Context) error {
+	c.checkLogin(ctx)
+	_, err := c.doHttpRequest(ctx, "sitemaster/run", http.MethodGet, nil, "")
+	if err != nil {
+		return err
+	}
+	return c.waitForSitemasterStatus(ctx, SitemasterStatusUp)
+}
+
+// waitForSitemasterStatus polls the sitemaster status until it matches status.
+// Transient errors (which are to be expected while the sitemaster is
+// restarting) are ignored, but any other error is returned immediately.
+func (c *Client) waitForSitemasterStatus(ctx context.Context, status string) error {
+	var lastErr error
+	for {
+		sm, err := c.GetSitemasterContext(ctx)
+		if err == nil && sm.Status == status {
+			c.logf("Sitemaster status is now %s", status)
+			return nil
+		}
+		if ctx.Err() != nil {
+			if lastErr != nil {
+				return fmt.Errorf("timed out waiting for sitemaster status %s (last error: %s): %w", status, lastErr, ctx.Err())
+			}
+			return fmt.Errorf("timed out waiting for sitemaster status %s: %w", status, ctx.Err())
+		}
+		if err != nil {
+			if !isTransient(err) {
+				return err
+			}
+			c.logf("Error checking sitemaster status (will retry): %s", err)
+			lastErr = err
+		}
+		err = sleepContext(ctx, sitemasterPollInterval)
+		if err != nil {
+			return fmt.Errorf("timed out waiting for sitemaster status %s: %w", status, err)
+		}
+	}
+}
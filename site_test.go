@@ -0,0 +1,69 @@
+package powerwall_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestStopStartSitemaster(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	if err := client.StopSitemaster(false); err != nil {
+		t.Fatal(err)
+	}
+	sm, err := client.GetSitemaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.Status != powerwall.SitemasterStatusDown {
+		t.Errorf("sitemaster was not stopped: %+v", sm)
+	}
+
+	if err := client.StartSitemaster(); err != nil {
+		t.Fatal(err)
+	}
+	sm, err = client.GetSitemaster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.Status != powerwall.SitemasterStatusUp {
+		t.Errorf("sitemaster was not started: %+v", sm)
+	}
+}
+
+func TestStopSitemasterCanReboot(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	s.SetFixture("sitemaster", powerwall.SitemasterData{
+		Status:    powerwall.SitemasterStatusUp,
+		Running:   true,
+		CanReboot: powerwall.SitemasterRebootPowerTooHigh,
+	})
+	err := client.StopSitemaster(false)
+	var cannotStop powerwall.SitemasterCannotStop
+	if !errors.As(err, &cannotStop) || cannotStop.Reason != powerwall.SitemasterRebootPowerTooHigh {
+		t.Errorf("expected SitemasterCannotStop, got %v", err)
+	}
+	if err := client.StopSitemaster(true); err != nil {
+		t.Errorf("forced stop failed: %v", err)
+	}
+
+	// Firmware which doesn't report can_reboot at all should not need
+	// force.
+	s.SetFixture("sitemaster", powerwall.SitemasterData{
+		Status:  powerwall.SitemasterStatusUp,
+		Running: true,
+	})
+	if err := client.StopSitemaster(false); err != nil {
+		t.Errorf("stop with no can_reboot failed: %v", err)
+	}
+}
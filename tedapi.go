@@ -0,0 +1,485 @@
+// Functions for accessing the gateway via the TEDAPI interface:
+//
+//   NewTEDAPIClient(gatewayAddress, gatewayPassword, options...)
+//   (*TEDAPIClient) SetStatusQuery(query)
+//   (*TEDAPIClient) GetDin()
+//   (*TEDAPIClient) GetDinContext(ctx)
+//   (*TEDAPIClient) GetConfig()
+//   (*TEDAPIClient) GetConfigContext(ctx)
+//   (*TEDAPIClient) QueryStatus()
+//   (*TEDAPIClient) QueryStatusContext(ctx)
+//   (*TEDAPIClient) GetSystemStatus()
+//   (*TEDAPIClient) GetSystemStatusContext(ctx)
+//   (*TEDAPIClient) GetMetersAggregates()
+//   (*TEDAPIClient) GetMetersAggregatesContext(ctx)
+//
+package powerwall
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Newer gateway firmware versions restrict access to many of the "/api/..."
+// endpoints, and instead provide the same sort of information via a
+// protobuf-based interface known as "TEDAPI".  This interface is only
+// available when connected directly to the gateway's own WiFi access point
+// (at 192.168.91.1), and uses the gateway password (printed on the label
+// inside the gateway's cover) instead of the customer login.
+//
+// The TEDAPIClient type provides access to this interface, and maps the
+// results into the same data types used by the rest of the library where
+// possible.  See tedapi.proto for details of the message format.
+
+// The username used for HTTP Basic auth with the TEDAPI.
+const tedapiUsername = "Tesla_Energy_Device"
+
+// ErrNoStatusQuery is returned by TEDAPIClient status functions if no status
+// query has been configured with SetStatusQuery.
+var ErrNoStatusQuery = errors.New("powerwall: no TEDAPI status query configured")
+
+// TEDAPIQuery contains a status query to be sent to the gateway via the
+// TEDAPI.  The gateway will only accept queries which have been signed by
+// Tesla, so the Text and Signature must be exactly as obtained from an
+// official source (for example, as captured from the Tesla One app).
+// Variables contains a JSON-encoded object containing any values for
+// variables used by the query (usually just "{}").
+type TEDAPIQuery struct {
+	Text      string
+	Signature []byte
+	Variables string
+}
+
+// TEDAPIClient represents a connection to a Tesla Energy Gateway using the
+// TEDAPI interface.
+type TEDAPIClient struct {
+	gatewayAddress  string
+	gatewayPort     int
+	gatewayPassword string
+	httpClient      http.Client
+	userAgent       string
+	logFunc         func(...interface{})
+	mutex           sync.Mutex
+	din             string
+	statusQuery     *TEDAPIQuery
+}
+
+// NewTEDAPIClient creates a new TEDAPIClient object.  gatewayAddress should
+// be the IP address of the gateway (normally "192.168.91.1", when connected
+// to the gateway's WiFi network), and gatewayPassword should be the gateway
+// password (not the customer login password).
+//
+// Any of the options accepted by NewClientWithOptions may be provided to
+// customize how the client connects to the gateway (except for WithLogin,
+// which is ignored).
+func NewTEDAPIClient(gatewayAddress string, gatewayPassword string, options ...Option) *TEDAPIClient {
+	opts := defaultClientOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+
+	t := &TEDAPIClient{
+		gatewayAddress:  gatewayAddress,
+		gatewayPort:     opts.port,
+		gatewayPassword: gatewayPassword,
+		httpClient:      opts.httpClient(),
+		userAgent:       opts.userAgent,
+		logFunc:         opts.logFunc,
+	}
+	t.logf("New TEDAPI client created: gateway_address=%s", gatewayAddress)
+	return t
+}
+
+func (t *TEDAPIClient) logf(format string, v ...interface{}) {
+	logFunc := logFunc
+	if t.logFunc != nil {
+		logFunc = t.logFunc
+	}
+	logFunc(fmt.Sprintf("{%p} ", t) + fmt.Sprintf(format, v...))
+}
+
+// SetStatusQuery sets the (signed) query which will be used to fetch the
+// gateway status by QueryStatus, GetSystemStatus, etc.  (See TEDAPIQuery for
+// more information.)
+func (t *TEDAPIClient) SetStatusQuery(query TEDAPIQuery) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.statusQuery = &query
+}
+
+func (t *TEDAPIClient) doRequest(ctx context.Context, method string, path string, payload []byte) ([]byte, error) {
+	host := t.gatewayAddress
+	if t.gatewayPort != 0 && t.gatewayPort != 443 {
+		host = net.JoinHostPort(t.gatewayAddress, strconv.Itoa(t.gatewayPort))
+	}
+	url := url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "tedapi/" + path,
+	}
+
+	t.logf("Calling TEDAPI: method=%s url=%s body=%s", method, url.String(), logBody("", payload, "application/octet-stream"))
+
+	var body *bytes.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	} else {
+		body = bytes.NewReader([]byte{})
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	req.SetBasicAuth(tedapiUsername, t.gatewayPassword)
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		t.logf("Request failed: status=%d", resp.StatusCode)
+		return nil, AuthFailure{
+			URL:       url,
+			ErrorText: http.StatusText(resp.StatusCode),
+			Message:   "TEDAPI rejected the gateway password",
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		t.logf("Request failed: status=%d body=%s", resp.StatusCode, logBody("", respData, resp.Header.Get("Content-Type")))
+		return nil, ApiError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			Body:       respData,
+		}
+	}
+
+	t.logf("Request succeeded: status=%d body=%s", resp.StatusCode, logBody("", respData, resp.Header.Get("Content-Type")))
+	return respData, nil
+}
+
+// GetDin returns the DIN (device identification number) of the gateway.  (This
+// is needed for addressing other TEDAPI requests, and will be fetched
+// automatically when needed, but may also be useful in its own right.)
+func (t *TEDAPIClient) GetDin() (string, error) {
+	return t.GetDinContext(context.Background())
+}
+
+// GetDinContext is the same as GetDin, but uses the provided context to allow
+// cancelling or setting a deadline on the request.
+func (t *TEDAPIClient) GetDinContext(ctx context.Context) (string, error) {
+	t.mutex.Lock()
+	din := t.din
+	t.mutex.Unlock()
+	if din != "" {
+		return din, nil
+	}
+
+	respData, err := t.doRequest(ctx, http.MethodGet, "din", nil)
+	if err != nil {
+		return "", err
+	}
+	din = strings.TrimSpace(string(respData))
+
+	t.mutex.Lock()
+	t.din = din
+	t.mutex.Unlock()
+	return din, nil
+}
+
+// sendMessage sends a TEDAPI request message to the gateway, with the
+// provided function used to fill in the envelope-specific parts of the
+// message, and returns the (decoded) envelope fields of the response.
+func (t *TEDAPIClient) sendMessage(ctx context.Context, f func(*pbWriter)) ([]pbField, error) {
+	din, err := t.GetDinContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &pbWriter{}
+	w.Message(1, func(env *pbWriter) {
+		env.Varint(1, 1) // deliveryChannel
+		env.Message(2, func(sender *pbWriter) {
+			sender.Varint(3, 1) // local
+		})
+		env.Message(3, func(recipient *pbWriter) {
+			recipient.String(1, din)
+		})
+		f(env)
+	})
+	w.Message(2, func(tail *pbWriter) {
+		tail.Varint(1, 1)
+	})
+
+	respData, err := t.doRequest(ctx, http.MethodPost, "v1", w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	fields, err := pbParse(respData)
+	if err == nil {
+		if envelope := pbFind(fields, 1); envelope != nil {
+			return pbParse(envelope.bytes)
+		}
+		err = errors.New("no message envelope in response")
+	}
+	err = fmt.Errorf("error decoding TEDAPI response: %w", err)
+	errFunc(fmt.Sprintf("Error decoding TEDAPI response (%d bytes)", len(respData)), err)
+	return nil, err
+}
+
+// fetchFile fetches the contents of the named file from the gateway.
+func (t *TEDAPIClient) fetchFile(ctx context.Context, name string) ([]byte, error) {
+	envelope, err := t.sendMessage(ctx, func(env *pbWriter) {
+		env.Message(15, func(config *pbWriter) {
+			config.Message(1, func(send *pbWriter) {
+				send.Varint(1, 1)
+				send.String(2, name)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// config.recv.file.text
+	f, err := pbFindPath(envelope, 15, 2, 1, 100)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, fmt.Errorf("no contents returned for file %q", name)
+	}
+	return f.bytes, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// TEDAPIConfigData contains some of the information from the gateway's
+// "config.json" file, as returned by the GetConfig function.  The full
+// contents of the file (which are quite extensive) are available in the Raw
+// field.
+type TEDAPIConfigData struct {
+	Vin           string       `json:"vin"`
+	SiteInfo      SiteInfoData `json:"site_info"`
+	BatteryBlocks []struct {
+		Vin  string `json:"vin"`
+		Type string `json:"type"`
+	} `json:"battery_blocks"`
+	Raw json.RawMessage `json:"-"`
+}
+
+// GetConfig fetches the "config.json" configuration file from the gateway.
+//
+// See the TEDAPIConfigData type for more information on what fields this returns.
+func (t *TEDAPIClient) GetConfig() (*TEDAPIConfigData, error) {
+	return t.GetConfigContext(context.Background())
+}
+
+// GetConfigContext is the same as GetConfig, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (t *TEDAPIClient) GetConfigContext(ctx context.Context) (*TEDAPIConfigData, error) {
+	data, err := t.fetchFile(ctx, "config.json")
+	if err != nil {
+		return nil, err
+	}
+	result := TEDAPIConfigData{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		errFunc(fmt.Sprintf("Error unmarshalling TEDAPI 'config.json' %s", string(data)), err)
+		return nil, err
+	}
+	result.Raw = json.RawMessage(data)
+	return &result, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// TEDAPIStatusData contains some of the information returned by the TEDAPI
+// status query, as returned by the QueryStatus function.  The full response
+// is available in the Raw field.
+type TEDAPIStatusData struct {
+	Control struct {
+		Alerts struct {
+			Active []string `json:"active"`
+		} `json:"alerts"`
+		BatteryBlocks []struct {
+			Din            string        `json:"din"`
+			DisableReasons []interface{} `json:"disableReasons"`
+		} `json:"batteryBlocks"`
+		Islanding struct {
+			CustomerIslandMode string        `json:"customerIslandMode"`
+			ContactorClosed    bool          `json:"contactorClosed"`
+			MicroGridOK        bool          `json:"microGridOK"`
+			GridOK             bool          `json:"gridOK"`
+			DisconnectReasons  []interface{} `json:"disconnectReasons"`
+		} `json:"islanding"`
+		MeterAggregates []struct {
+			Location   string  `json:"location"`
+			RealPowerW float32 `json:"realPowerW"`
+		} `json:"meterAggregates"`
+		SiteShutdown struct {
+			IsShutDown bool          `json:"isShutDown"`
+			Reasons    []interface{} `json:"reasons"`
+		} `json:"siteShutdown"`
+		SystemStatus struct {
+			NominalEnergyRemainingWh float32 `json:"nominalEnergyRemainingWh"`
+			NominalFullPackEnergyWh  float32 `json:"nominalFullPackEnergyWh"`
+		} `json:"systemStatus"`
+	} `json:"control"`
+	Raw json.RawMessage `json:"-"`
+}
+
+// QueryStatus performs a status query (as configured with SetStatusQuery) and
+// returns the results.  If no status query has been configured, this will
+// return ErrNoStatusQuery.
+//
+// See the TEDAPIStatusData type for more information on what fields this returns.
+func (t *TEDAPIClient) QueryStatus() (*TEDAPIStatusData, error) {
+	return t.QueryStatusContext(context.Background())
+}
+
+// QueryStatusContext is the same as QueryStatus, but uses the provided context
+// to allow cancelling or setting a deadline on the request.
+func (t *TEDAPIClient) QueryStatusContext(ctx context.Context) (*TEDAPIStatusData, error) {
+	t.mutex.Lock()
+	query := t.statusQuery
+	t.mutex.Unlock()
+	if query == nil {
+		return nil, ErrNoStatusQuery
+	}
+	variables := query.Variables
+	if variables == "" {
+		variables = "{}"
+	}
+
+	envelope, err := t.sendMessage(ctx, func(env *pbWriter) {
+		env.Message(16, func(payload *pbWriter) {
+			payload.Message(1, func(send *pbWriter) {
+				send.Varint(1, 2)
+				send.Message(2, func(ps *pbWriter) {
+					ps.Varint(1, 1)
+					ps.String(2, query.Text)
+				})
+				send.RawBytes(3, query.Signature)
+				send.Message(4, func(b *pbWriter) {
+					b.String(1, variables)
+				})
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// payload.recv.text
+	f, err := pbFindPath(envelope, 16, 2, 2)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, errors.New("no status returned by TEDAPI query")
+	}
+	result := TEDAPIStatusData{}
+	err = json.Unmarshal(f.bytes, &result)
+	if err != nil {
+		errFunc(fmt.Sprintf("Error unmarshalling TEDAPI status %s", string(f.bytes)), err)
+		return nil, err
+	}
+	result.Raw = json.RawMessage(f.bytes)
+	return &result, nil
+}
+
+// GetSystemStatus performs a status query and converts the results into a
+// SystemStatusData structure, for compatibility with (*Client).GetSystemStatus.
+//
+// Note that the TEDAPI does not provide all of the same information, so only
+// the following fields will be filled in: NominalFullPackEnergy,
+// NominalEnergyRemaining, SystemIslandState, AvailableBlocks, and (for each
+// of the BatteryBlocks) PackagePartNumber, PackageSerialNumber, and
+// DisabledReasons.
+func (t *TEDAPIClient) GetSystemStatus() (*SystemStatusData, error) {
+	return t.GetSystemStatusContext(context.Background())
+}
+
+// GetSystemStatusContext is the same as GetSystemStatus, but uses the
+// provided context to allow cancelling or setting a deadline on the request.
+func (t *TEDAPIClient) GetSystemStatusContext(ctx context.Context) (*SystemStatusData, error) {
+	status, err := t.QueryStatusContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := SystemStatusData{
+		NominalFullPackEnergy:  status.Control.SystemStatus.NominalFullPackEnergyWh,
+		NominalEnergyRemaining: status.Control.SystemStatus.NominalEnergyRemainingWh,
+		AvailableBlocks:        len(status.Control.BatteryBlocks),
+	}
+	if status.Control.Islanding.GridOK {
+		result.SystemIslandState = GridStatusConnected
+	} else {
+		result.SystemIslandState = GridStatusIslanded
+	}
+
+	result.BatteryBlocks = make([]BatteryBlockData, 0, len(status.Control.BatteryBlocks))
+	for _, b := range status.Control.BatteryBlocks {
+		// DINs are of the form "<part number>--<serial number>"
+		parts := strings.SplitN(b.Din, "--", 2)
+		block := BatteryBlockData{
+			PackagePartNumber: parts[0],
+			DisabledReasons:   b.DisableReasons,
+		}
+		if len(parts) > 1 {
+			block.PackageSerialNumber = parts[1]
+		}
+		result.BatteryBlocks = append(result.BatteryBlocks, block)
+	}
+
+	return &result, nil
+}
+
+// GetMetersAggregates performs a status query and converts the results into
+// MeterAggregatesData structures, for compatibility with
+// (*Client).GetMetersAggregates.
+//
+// Note that the TEDAPI does not provide all of the same information, so only
+// the InstantPower field will be filled in.
+func (t *TEDAPIClient) GetMetersAggregates() (*map[string]MeterAggregatesData, error) {
+	return t.GetMetersAggregatesContext(context.Background())
+}
+
+// GetMetersAggregatesContext is the same as GetMetersAggregates, but uses the
+// provided context to allow cancelling or setting a deadline on the request.
+func (t *TEDAPIClient) GetMetersAggregatesContext(ctx context.Context) (*map[string]MeterAggregatesData, error) {
+	status, err := t.QueryStatusContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]MeterAggregatesData{}
+	for _, m := range status.Control.MeterAggregates {
+		// The TEDAPI reports locations in upper-case ("SITE", "LOAD",
+		// etc), but the JSON API uses lower-case.
+		result[strings.ToLower(m.Location)] = MeterAggregatesData{
+			InstantPower: m.RealPowerW,
+		}
+	}
+	return &result, nil
+}
@@ -0,0 +1,186 @@
+package powerwall
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const testTEDAPIDin = "1232100-00-E--TG123456789ABC"
+
+const testTEDAPIStatus = `{
+  "control": {
+    "alerts": {"active": ["SystemConnectedToGrid"]},
+    "batteryBlocks": [
+      {"din": "2012170-25-E--TG000000000001", "disableReasons": []},
+      {"din": "2012170-25-E--TG000000000002", "disableReasons": ["Foo"]}
+    ],
+    "islanding": {"customerIslandMode": "Online", "contactorClosed": true, "microGridOK": true, "gridOK": true},
+    "meterAggregates": [
+      {"location": "SITE", "realPowerW": 1200},
+      {"location": "LOAD", "realPowerW": 2500.5}
+    ],
+    "siteShutdown": {"isShutDown": false, "reasons": []},
+    "systemStatus": {"nominalEnergyRemainingWh": 13500, "nominalFullPackEnergyWh": 27000}
+  }
+}`
+
+// newTestTEDAPIServer starts a stand-in for the gateway's TEDAPI endpoints,
+// which answers file requests for "config.json" and status queries with
+// canned data.
+func newTestTEDAPIServer(t *testing.T, query TEDAPIQuery) (*httptest.Server, *TEDAPIClient) {
+	reply := func(w http.ResponseWriter, f func(*pbWriter)) {
+		pw := &pbWriter{}
+		pw.Message(1, f)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(pw.Bytes())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tedapi/din", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testTEDAPIDin + "\n"))
+	})
+	mux.HandleFunc("/tedapi/v1", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fields, err := pbParse(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recipient, _ := pbFindPath(fields, 1, 3, 1)
+		if recipient == nil || string(recipient.bytes) != testTEDAPIDin {
+			http.Error(w, "wrong recipient", http.StatusBadRequest)
+			return
+		}
+		if f, _ := pbFindPath(fields, 1, 15, 1, 2); f != nil {
+			if string(f.bytes) != "config.json" {
+				http.NotFound(w, r)
+				return
+			}
+			reply(w, func(env *pbWriter) {
+				env.Message(15, func(config *pbWriter) {
+					config.Message(2, func(recv *pbWriter) {
+						recv.Message(1, func(file *pbWriter) {
+							file.String(100, `{"vin": "1232100-00-E--TG123456789ABC", "site_info": {"site_name": "Home"}, "battery_blocks": [{"vin": "2012170-25-E--TG000000000001", "type": "Powerwall2"}]}`)
+						})
+					})
+				})
+			})
+			return
+		}
+		text, _ := pbFindPath(fields, 1, 16, 1, 2, 2)
+		sig, _ := pbFindPath(fields, 1, 16, 1, 3)
+		if text == nil || sig == nil || string(text.bytes) != query.Text || !bytes.Equal(sig.bytes, query.Signature) {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		reply(w, func(env *pbWriter) {
+			env.Message(16, func(payload *pbWriter) {
+				payload.Message(2, func(recv *pbWriter) {
+					recv.String(2, testTEDAPIStatus)
+				})
+			})
+		})
+	})
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != tedapiUsername || pass != "gatewaypw" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	host, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	client := NewTEDAPIClient(host, "gatewaypw", WithPort(port), WithLogger(t.Log))
+	return server, client
+}
+
+func TestTEDAPIConfig(t *testing.T) {
+	_, client := newTestTEDAPIServer(t, TEDAPIQuery{})
+
+	din, err := client.GetDin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if din != testTEDAPIDin {
+		t.Errorf("GetDin returned %q", din)
+	}
+
+	config, err := client.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Vin != testTEDAPIDin || config.SiteInfo.SiteName != "Home" {
+		t.Errorf("bad config: %+v", config)
+	}
+	if len(config.BatteryBlocks) != 1 || config.BatteryBlocks[0].Type != "Powerwall2" {
+		t.Errorf("bad battery blocks: %+v", config.BatteryBlocks)
+	}
+}
+
+func TestTEDAPIStatus(t *testing.T) {
+	query := TEDAPIQuery{Text: "query DeviceControllerQuery { control { systemStatus { nominalFullPackEnergyWh } } }", Signature: []byte{0x30, 0x81, 0x88, 0x02}}
+	_, client := newTestTEDAPIServer(t, query)
+	client.SetStatusQuery(query)
+
+	status, err := client.GetSystemStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.NominalFullPackEnergy != 27000 || status.NominalEnergyRemaining != 13500 {
+		t.Errorf("bad energy values: %+v", status)
+	}
+	if status.SystemIslandState != GridStatusConnected || status.AvailableBlocks != 2 {
+		t.Errorf("bad island state or block count: %+v", status)
+	}
+	if len(status.BatteryBlocks) != 2 {
+		t.Fatalf("expected 2 battery blocks, got %d", len(status.BatteryBlocks))
+	}
+	b := status.BatteryBlocks[1]
+	if b.PackagePartNumber != "2012170-25-E" || b.PackageSerialNumber != "TG000000000002" || len(b.DisabledReasons) != 1 {
+		t.Errorf("bad battery block: %+v", b)
+	}
+
+	meters, err := client.GetMetersAggregates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*meters)["site"].InstantPower != 1200 || (*meters)["load"].InstantPower != 2500.5 {
+		t.Errorf("bad meter aggregates: %+v", *meters)
+	}
+}
+
+func TestTEDAPIErrors(t *testing.T) {
+	server, client := newTestTEDAPIServer(t, TEDAPIQuery{Text: "query", Signature: []byte{1}})
+	if _, err := client.QueryStatus(); err != ErrNoStatusQuery {
+		t.Errorf("expected ErrNoStatusQuery, got %v", err)
+	}
+
+	client.SetStatusQuery(TEDAPIQuery{Text: "query", Signature: []byte{2}})
+	_, err := client.QueryStatus()
+	var apiErr ApiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 ApiError, got %v", err)
+	}
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	badClient := NewTEDAPIClient("127.0.0.1", "wrong", WithPort(p), WithLogger(t.Log))
+	_, err = badClient.GetDin()
+	var authErr AuthFailure
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected AuthFailure, got %v", err)
+	}
+}
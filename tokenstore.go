@@ -0,0 +1,413 @@
+// Functions for persisting auth tokens:
+//
+// (Note: A TokenStore is used by a Client if supplied with the WithTokenStore
+// option)
+//
+//   NewMemoryTokenStore()
+//   NewFileTokenStore(path)
+//   NewEncryptedFileTokenStore(path, passphrase)
+//
+package powerwall
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenStore is implemented by anything which can save an auth token and load
+// it back again later.  If a Client is created with the WithTokenStore option,
+// it will load its initial auth token from the store, and save the new token
+// to it every time it logs in.
+//
+// A TokenStore may be shared by more than one Client (or, depending on the
+// implementation, by more than one process).  In that case, it should
+// generally also implement TokenLocker.
+type TokenStore interface {
+	// LoadToken returns the saved token, or an empty string if there
+	// isn't one.
+	LoadToken() (string, error)
+	// SaveToken saves a new token.
+	SaveToken(token string) error
+}
+
+// TokenLocker can be implemented by a TokenStore to allow Clients sharing the
+// same store to coordinate their logins.  A Client will hold the lock while
+// logging in, and before logging in, will check whether the store contains a
+// different token from the one it was using.  If it does, it will assume some
+// other Client has already logged in, and use that token instead.  This
+// avoids a stampede of logins when several clients find their token has
+// expired at the same time.
+type TokenLocker interface {
+	// LockToken waits until the lock can be acquired (or ctx is
+	// cancelled), and returns a function which will release it.
+	LockToken(ctx context.Context) (unlock func(), err error)
+}
+
+// login logs into the gateway, using the token store (if any) to share tokens
+// with other clients.  current is the token we currently have (if any).
+func (c *Client) login(ctx context.Context, current string) (string, error) {
+	store := c.tokenStore
+	if store == nil {
+		return c.performLogin(ctx)
+	}
+
+	if locker, ok := store.(TokenLocker); ok {
+		unlock, err := locker.LockToken(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", err
+			}
+			// We'll just have to do without it.
+			c.logf("Unable to lock token store: %s", err)
+		} else {
+			defer unlock()
+		}
+	}
+
+	stored, err := store.LoadToken()
+	if err != nil {
+		c.logf("Unable to load token from token store: %s", err)
+	} else if stored != "" && stored != current {
+		c.logf("Using newer auth token from token store")
+		c.setRoles(nil)
+		return stored, nil
+	}
+
+	token, err := c.performLogin(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = store.SaveToken(token)
+	if err != nil {
+		c.logf("Unable to save token to token store: %s", err)
+		errFunc("Unable to save auth token", err)
+	}
+	return token, nil
+}
+
+// loadStoredToken returns the token from the token store (if any) to use when
+// the client starts up.
+func (c *Client) loadStoredToken() string {
+	if c.tokenStore == nil {
+		return ""
+	}
+	token, err := c.tokenStore.LoadToken()
+	if err != nil {
+		c.logf("Unable to load token from token store: %s", err)
+		return ""
+	}
+	if token != "" {
+		c.logf("Loaded auth token from token store")
+	}
+	return token
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// MemoryTokenStore is a TokenStore which just keeps the token in memory.  This
+// is useful for sharing a single login between several Clients in the same
+// process.
+type MemoryTokenStore struct {
+	mutex sync.Mutex
+	token string
+	lock  chan struct{}
+}
+
+// NewMemoryTokenStore creates a new, empty, MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{lock: make(chan struct{}, 1)}
+}
+
+// LoadToken implements the TokenStore interface.
+func (s *MemoryTokenStore) LoadToken() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token, nil
+}
+
+// SaveToken implements the TokenStore interface.
+func (s *MemoryTokenStore) SaveToken(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = token
+	return nil
+}
+
+// LockToken implements the TokenLocker interface.
+func (s *MemoryTokenStore) LockToken(ctx context.Context) (func(), error) {
+	select {
+	case s.lock <- struct{}{}:
+		return func() { <-s.lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// FileTokenStore is a TokenStore which saves the token in a file.  The file
+// contains just the token, as plain text.  (This is the same format used by
+// the --authcache option of powerwall-cmd.)
+//
+// FileTokenStore also implements TokenLocker, using a separate lock file (the
+// same name as the token file, with ".lock" appended), so it can be safely
+// shared between multiple processes.
+type FileTokenStore struct {
+	// Path is the name of the token file.
+	Path string
+	// StaleLockAge is how old a lock file must be before it is assumed
+	// that whoever created it has died without removing it, and it is
+	// ignored.  (The lock file is refreshed every StaleLockAge/3 while
+	// the lock is held.)
+	StaleLockAge time.Duration
+	// LockPollInterval is how often to check whether the lock has been
+	// released, when waiting for it.
+	LockPollInterval time.Duration
+}
+
+// NewFileTokenStore creates a new FileTokenStore which uses the specified
+// file.
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{
+		Path:             path,
+		StaleLockAge:     time.Minute,
+		LockPollInterval: 100 * time.Millisecond,
+	}
+}
+
+// LoadToken implements the TokenStore interface.  If the file does not exist,
+// it returns an empty token (and no error).
+func (s *FileTokenStore) LoadToken() (string, error) {
+	data, err := s.readFile()
+	if err != nil || data == nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SaveToken implements the TokenStore interface.
+func (s *FileTokenStore) SaveToken(token string) error {
+	return s.writeFile([]byte(token))
+}
+
+// LockToken implements the TokenLocker interface.
+//
+// The lock file is created atomically (so only one process can create it), and
+// while the lock is held, its modification time is updated periodically, so
+// that a lock file is only considered stale if its owner has actually gone
+// away.
+func (s *FileTokenStore) LockToken(ctx context.Context) (func(), error) {
+	lockPath := s.Path + ".lock"
+	id := fmt.Sprintf("%d %s", os.Getpid(), randomHex(8))
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintln(f, id)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, err
+			}
+			return s.holdLock(lockPath, id), nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if s.breakStaleLock(lockPath) {
+			continue
+		}
+		err = sleepContext(ctx, s.LockPollInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// holdLock keeps the lock file (which we have just created, containing id)
+// fresh until the returned unlock function is called.
+func (s *FileTokenStore) holdLock(lockPath string, id string) func() {
+	done := make(chan struct{})
+	if s.StaleLockAge > 0 {
+		go func() {
+			ticker := time.NewTicker(s.StaleLockAge / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					now := time.Now()
+					os.Chtimes(lockPath, now, now)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			// Only remove the lock file if it's still ours (if it
+			// isn't, someone decided we'd gone away and took it
+			// over, and it's theirs now).
+			data, err := ioutil.ReadFile(lockPath)
+			if err == nil && strings.TrimSpace(string(data)) == id {
+				os.Remove(lockPath)
+			}
+		})
+	}
+}
+
+// breakStaleLock removes the lock file if it is stale (whoever created it must
+// have gone away without cleaning up).  It returns true if the lock file is
+// now gone, and it is worth trying to create it again straight away.
+func (s *FileTokenStore) breakStaleLock(lockPath string) bool {
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	if s.StaleLockAge <= 0 || time.Since(info.ModTime()) <= s.StaleLockAge {
+		return false
+	}
+	// Other processes may be trying to do this at the same time, so we
+	// can't just remove it (we might end up removing a new lock file
+	// someone else has just created instead).  Instead, we atomically
+	// move it somewhere else, and then check that what we moved really
+	// was the stale one.
+	stalePath := lockPath + ".stale." + randomHex(8)
+	if err := os.Rename(lockPath, stalePath); err != nil {
+		return false
+	}
+	defer os.Remove(stalePath)
+	info, err = os.Stat(stalePath)
+	if err == nil && time.Since(info.ModTime()) <= s.StaleLockAge {
+		// Someone else broke the stale lock and took a new one just
+		// before we moved it.  Put it back.
+		os.Link(stalePath, lockPath)
+		return false
+	}
+	return true
+}
+
+// randomHex returns a random string of n bytes, hex-encoded.
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		// This should never happen, but if it somehow does, the
+		// time is at least unlikely to collide.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// readFile returns the contents of the token file, or nil if it doesn't exist.
+func (s *FileTokenStore) readFile() ([]byte, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeFile replaces the contents of the token file.  This writes to a
+// temporary file first and then renames it, so that anyone reading the file at
+// the same time will never see a partially-written token.
+func (s *FileTokenStore) writeFile(data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// EncryptedFileTokenStore is the same as FileTokenStore, but the token is
+// encrypted (using AES-GCM, with a key derived from a passphrase) before it
+// is written to the file.
+type EncryptedFileTokenStore struct {
+	FileTokenStore
+	aead cipher.AEAD
+}
+
+// NewEncryptedFileTokenStore creates a new EncryptedFileTokenStore which uses
+// the specified file, and encrypts the token using the provided passphrase.
+func NewEncryptedFileTokenStore(path string, passphrase string) *EncryptedFileTokenStore {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		// This can only happen if the key is the wrong size, which it
+		// isn't.
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &EncryptedFileTokenStore{
+		FileTokenStore: *NewFileTokenStore(path),
+		aead:           aead,
+	}
+}
+
+// LoadToken implements the TokenStore interface.  If the file does not exist,
+// it returns an empty token (and no error).  If the file cannot be decrypted
+// (for example, because the passphrase is wrong), an error is returned.
+func (s *EncryptedFileTokenStore) LoadToken() (string, error) {
+	data, err := s.readFile()
+	if err != nil || data == nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted token file %s: %w", s.Path, err)
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("invalid encrypted token file %s: too short", s.Path)
+	}
+	token, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt token file %s: %w", s.Path, err)
+	}
+	return string(token), nil
+}
+
+// SaveToken implements the TokenStore interface.
+func (s *EncryptedFileTokenStore) SaveToken(token string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(token), nil)
+	return s.writeFile([]byte(base64.StdEncoding.EncodeToString(sealed)))
+}
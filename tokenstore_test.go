@@ -0,0 +1,190 @@
+package powerwall_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+)
+
+// testLockExclusion checks that only one goroutine at a time can hold the lock
+// from locker.
+func testLockExclusion(t *testing.T, locker powerwall.TokenLocker) {
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			unlock, err := locker.LockToken(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				max := atomic.LoadInt32(&maxHolders)
+				if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("lock was held by %d goroutines at once", maxHolders)
+	}
+}
+
+// testLockCancel checks that waiting for a lock which is already held is
+// cut short by the context.
+func testLockCancel(t *testing.T, locker powerwall.TokenLocker) {
+	unlock, err := locker.LockToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := locker.LockToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded while waiting for the lock, got %v", err)
+	}
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	s := powerwall.NewMemoryTokenStore()
+	if token, err := s.LoadToken(); token != "" || err != nil {
+		t.Errorf("new store returned %q, %v", token, err)
+	}
+	if err := s.SaveToken("abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := s.LoadToken(); token != "abc123" || err != nil {
+		t.Errorf("expected saved token, got %q, %v", token, err)
+	}
+	testLockExclusion(t, s)
+	testLockCancel(t, s)
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	s := powerwall.NewFileTokenStore(path)
+	s.LockPollInterval = time.Millisecond
+
+	// A missing file is just an empty token.
+	if token, err := s.LoadToken(); token != "" || err != nil {
+		t.Errorf("missing file returned %q, %v", token, err)
+	}
+	if err := s.SaveToken("abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := s.LoadToken(); token != "abc123" || err != nil {
+		t.Errorf("expected saved token, got %q, %v", token, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("token file is accessible by others (mode %v)", info.Mode())
+	}
+
+	testLockExclusion(t, s)
+	testLockCancel(t, s)
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed when unlocked")
+	}
+}
+
+func TestFileTokenStoreStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	lockPath := path + ".lock"
+	s := powerwall.NewFileTokenStore(path)
+	s.StaleLockAge = time.Second
+	s.LockPollInterval = time.Millisecond
+
+	// A lock file left behind by a process which has gone away.
+	if err := ioutil.WriteFile(lockPath, []byte("12345 deadbeef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several waiters should all notice it's stale, but only one should
+	// get the lock at a time.
+	testLockExclusion(t, s)
+
+	// A lock which is held for longer than StaleLockAge is kept fresh,
+	// so nobody else takes it over.
+	unlock, err := s.LockToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*s.StaleLockAge)
+	defer cancel()
+	if _, err := s.LockToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lock held by a live owner was taken over (err=%v)", err)
+	}
+
+	// If someone else has taken over the lock, unlocking should not
+	// remove their lock file.
+	if err := ioutil.WriteFile(lockPath, []byte("12345 someoneelse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil || !strings.Contains(string(data), "someoneelse") {
+		t.Errorf("unlock removed someone else's lock file (%q, %v)", data, err)
+	}
+	matches, _ := filepath.Glob(lockPath + ".stale.*")
+	if len(matches) != 0 {
+		t.Errorf("stale lock files left behind: %v", matches)
+	}
+}
+
+func TestEncryptedFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	s := powerwall.NewEncryptedFileTokenStore(path, "secret")
+
+	if token, err := s.LoadToken(); token != "" || err != nil {
+		t.Errorf("missing file returned %q, %v", token, err)
+	}
+	if err := s.SaveToken("abc123"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "abc123") {
+		t.Errorf("token was saved unencrypted")
+	}
+	if token, err := powerwall.NewEncryptedFileTokenStore(path, "secret").LoadToken(); token != "abc123" || err != nil {
+		t.Errorf("expected saved token, got %q, %v", token, err)
+	}
+
+	if token, err := powerwall.NewEncryptedFileTokenStore(path, "wrong").LoadToken(); err == nil {
+		t.Errorf("expected an error with the wrong passphrase, got %q", token)
+	}
+	if err := ioutil.WriteFile(path, []byte("not base64!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadToken(); err == nil {
+		t.Errorf("expected an error for a corrupt token file")
+	}
+}
@@ -1,5 +1,7 @@
 package powerwall
 
+import "context"
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // TroubleshootingProblemsData contains info returned by the "troubleshooting/problems" API call.
@@ -10,6 +12,8 @@ package powerwall
 // This structure is returned by the GetProblems function.
 type TroubleshootingProblemsData struct {
 	Problems []interface{} `json:"problems"` // TODO: Unsure what type these values are when present
+
+	Extra map[string]interface{} `json:"-"` // Unrecognized fields (see WithSchemaCheck)
 }
 
 // GetProblems returns info about "troubleshooting problems" currently reported
@@ -19,8 +23,14 @@ type TroubleshootingProblemsData struct {
 //
 // See the TroubleshootingProblemsData type for more information on what fields this returns.
 func (c *Client) GetProblems() (*TroubleshootingProblemsData, error) {
-	c.checkLogin()
+	return c.GetProblemsContext(context.Background())
+}
+
+// GetProblemsContext is the same as GetProblems, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetProblemsContext(ctx context.Context) (*TroubleshootingProblemsData, error) {
+	c.checkLogin(ctx)
 	result := TroubleshootingProblemsData{}
-	err := c.apiGetJson("troubleshooting/problems", &result)
+	err := c.apiGetJson(ctx, "troubleshooting/problems", &result)
 	return &result, err
 }
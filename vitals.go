@@ -0,0 +1,498 @@
+// Functions for reading detailed device information:
+//
+//   (*Client) GetVitals()
+//   (*Client) GetVitalsContext(ctx)
+//
+package powerwall
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+
+// VitalsData contains information returned by the "devices/vitals" API call
+// for a single device in the system (battery inverters (PINV), solar
+// inverters (PVAC), solar optimizers (PVS), the gateway's sync and meter
+// hardware (TESYNC), battery thermal controllers (THC), etc).
+//
+// Unlike most of the other API calls, "devices/vitals" returns its data in
+// protobuf format instead of JSON.  See vitals.proto for details of the
+// message format.
+//
+// The Vitals field contains all of the individual readings reported by the
+// device, keyed by name (for example "PINV_Fout", "THC_AmbientTemp", etc).
+// Each value will be one of int64, float64, string, or bool, depending on the
+// type of reading.  The Float, StringValue and Bool functions can be used to
+// conveniently retrieve values of a particular type.
+//
+// DeviceType is the prefix shared by the names of the device's vitals (e.g.
+// "PINV", "PVAC", "THC", etc), which indicates what sort of device it is.
+//
+// For the types of device we know about, the most useful readings are also
+// decoded into the corresponding typed field (PINV, POD, THC, PVAC, PVS or
+// TESYNC).  Only the one matching the device's type will be set.
+//
+// A map of this structure (keyed by DIN) is returned by the GetVitals function.
+type VitalsData struct {
+	Din                    string                 `json:"din"`
+	DeviceType             string                 `json:"device_type"`
+	PartNumber             string                 `json:"part_number"`
+	SerialNumber           string                 `json:"serial_number"`
+	Manufacturer           string                 `json:"manufacturer"`
+	SiteLabel              string                 `json:"site_label"`
+	ComponentParentDin     string                 `json:"component_parent_din"`
+	FirmwareVersion        string                 `json:"firmware_version"`
+	FirstCommunicationTime time.Time              `json:"first_communication_time"`
+	LastCommunicationTime  time.Time              `json:"last_communication_time"`
+	Vitals                 map[string]interface{} `json:"vitals"`
+	Alerts                 []string               `json:"alerts"`
+
+	PINV   *PINVVitals   `json:"pinv,omitempty"`
+	POD    *PODVitals    `json:"pod,omitempty"`
+	THC    *THCVitals    `json:"thc,omitempty"`
+	PVAC   *PVACVitals   `json:"pvac,omitempty"`
+	PVS    *PVSVitals    `json:"pvs,omitempty"`
+	TESYNC *TESYNCVitals `json:"tesync,omitempty"`
+}
+
+// PINVVitals contains the readings from a battery inverter (PINV).
+type PINVVitals struct {
+	State               string  // PINV_State
+	GridState           string  // PINV_GridState
+	Fout                float64 // PINV_Fout (Hz)
+	Vout                float64 // PINV_Vout (V)
+	VSplit1             float64 // PINV_VSplit1 (V)
+	VSplit2             float64 // PINV_VSplit2 (V)
+	Pout                float64 // PINV_Pout (kW)
+	PllFrequency        float64 // PINV_PllFrequency (Hz)
+	PllLocked           bool    // PINV_PllLocked
+	EnergyCharged       float64 // PINV_EnergyCharged (Wh)
+	EnergyDischarged    float64 // PINV_EnergyDischarged (Wh)
+	ReadyForGridForming bool    // PINV_ReadyForGridForming
+	HardwareEnableLine  bool    // PINV_hardwareEnableLine
+}
+
+// PODVitals contains the readings from a battery pod (TEPOD).
+type PODVitals struct {
+	NominalEnergyRemaining  float64 // POD_nom_energy_remaining (Wh)
+	NominalEnergyToCharge   float64 // POD_nom_energy_to_be_charged (Wh)
+	NominalFullPackEnergy   float64 // POD_nom_full_pack_energy (Wh)
+	AvailableChargePower    float64 // POD_available_charge_power (W)
+	AvailableDischargePower float64 // POD_available_dischg_power (W)
+	ActiveHeating           bool    // POD_ActiveHeating
+	ChargeComplete          bool    // POD_ChargeComplete
+	ChargeRequest           bool    // POD_ChargeRequest
+	DischargeComplete       bool    // POD_DischargeComplete
+	PermanentlyFaulted      bool    // POD_PermanentlyFaulted
+	PersistentlyFaulted     bool    // POD_PersistentlyFaulted
+	EnableLine              bool    // POD_enable_line
+	// CellVoltages contains any cell (or brick) voltage readings the pod
+	// reports, keyed by vital name.  Not all firmware versions report
+	// these.
+	CellVoltages map[string]float64
+}
+
+// THCVitals contains the readings from a battery thermal controller (TETHC).
+type THCVitals struct {
+	State       string  // THC_State
+	AmbientTemp float64 // THC_AmbientTemp (C)
+}
+
+// PVACVitals contains the readings from a solar inverter (PVAC).
+type PVACVitals struct {
+	State                 string  // PVAC_State
+	Fout                  float64 // PVAC_Fout (Hz)
+	Vout                  float64 // PVAC_Vout (V)
+	Pout                  float64 // PVAC_Pout (W)
+	VL1Ground             float64 // PVAC_VL1Ground (V)
+	VL2Ground             float64 // PVAC_VL2Ground (V)
+	LifetimeEnergyPVTotal float64 // PVAC_LifetimeEnergyPV_Total (Wh)
+	// Strings contains the readings for each solar string input, keyed
+	// by string name ("A", "B", etc).
+	Strings map[string]PVStringVitals
+}
+
+// PVStringVitals contains the readings for a single string input of a solar
+// inverter.
+type PVStringVitals struct {
+	State   string  // PVAC_PvState_<string>
+	Current float64 // PVAC_PVCurrent_<string> (A)
+	Voltage float64 // PVAC_PVMeasuredVoltage_<string> (V)
+	Power   float64 // PVAC_PVMeasuredPower_<string> (W)
+}
+
+// PVSVitals contains the readings from a solar optimizer/string controller
+// (PVS).
+type PVSVitals struct {
+	State         string  // PVS_State
+	SelfTestState string  // PVS_SelfTestState
+	VLL           float64 // PVS_vLL (V)
+	EnableOutput  bool    // PVS_EnableOutput
+	// StringConnected indicates whether each string is connected, keyed
+	// by string name ("A", "B", etc).
+	StringConnected map[string]bool
+}
+
+// TESYNCVitals contains the readings from the gateway's sync/islanding
+// hardware (TESYNC).
+type TESYNCVitals struct {
+	GridState     string  // ISLAND_GridState
+	GridConnected bool    // ISLAND_GridConnected
+	FreqL1Main    float64 // ISLAND_FreqL1_Main (Hz)
+	FreqL1Load    float64 // ISLAND_FreqL1_Load (Hz)
+	VL1NMain      float64 // ISLAND_VL1N_Main (V)
+	VL1NLoad      float64 // ISLAND_VL1N_Load (V)
+}
+
+// Float returns the value of the named vital as a float64.  Integer values are
+// converted automatically.  If the vital is not present (or is not a number),
+// ok will be false.
+func (v *VitalsData) Float(name string) (value float64, ok bool) {
+	switch x := v.Vitals[name].(type) {
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// StringValue returns the value of the named vital as a string.  If the vital
+// is not present (or is not a string), ok will be false.
+func (v *VitalsData) StringValue(name string) (value string, ok bool) {
+	value, ok = v.Vitals[name].(string)
+	return
+}
+
+// Bool returns the value of the named vital as a bool.  If the vital is not
+// present (or is not a bool), ok will be false.
+func (v *VitalsData) Bool(name string) (value bool, ok bool) {
+	value, ok = v.Vitals[name].(bool)
+	return
+}
+
+// Temperatures returns all of the temperature readings (vitals with "Temp" in
+// their names) reported by the device, as a map of name to value.
+func (v *VitalsData) Temperatures() map[string]float64 {
+	result := map[string]float64{}
+	for name := range v.Vitals {
+		if !strings.Contains(name, "Temp") {
+			continue
+		}
+		if value, ok := v.Float(name); ok {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// GetVitals returns detailed information about each of the devices in the
+// system, including temperatures, voltages, alerts, firmware versions, etc,
+// which are not available through the other (JSON) API calls.
+//
+// The result is a map of device DIN to VitalsData.  (Some devices do not
+// report a DIN.  These are keyed by "<part number>--<serial number>" instead,
+// or if they do not report those either, by "<device type>#<n>".)
+//
+// Note: This API is not available on all firmware versions.
+//
+// See the VitalsData type for more information on what fields this returns.
+func (c *Client) GetVitals() (*map[string]VitalsData, error) {
+	return c.GetVitalsContext(context.Background())
+}
+
+// GetVitalsContext is the same as GetVitals, but uses the provided context to
+// allow cancelling or setting a deadline on the request.
+func (c *Client) GetVitalsContext(ctx context.Context) (*map[string]VitalsData, error) {
+	c.checkLogin(ctx)
+	respData, err := c.doHttpRequest(ctx, "devices/vitals", http.MethodGet, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	result, err := decodeVitals(respData)
+	if err != nil {
+		msg := fmt.Sprintf("Error decoding 'devices/vitals' response (%d bytes)", len(respData))
+		errFunc(msg, err)
+		return nil, err
+	}
+	return &result, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// decodeVitals decodes a DevicesWithVitals message.
+func decodeVitals(data []byte) (map[string]VitalsData, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]VitalsData{}
+	for _, f := range fields {
+		if f.num != 1 || f.wireType != pbWireBytes {
+			continue
+		}
+		device, err := decodeDeviceWithVitals(f.bytes)
+		if err != nil {
+			return nil, err
+		}
+		result[vitalsKey(result, device)] = *device
+	}
+	return result, nil
+}
+
+// vitalsKey returns the key to use for device in the GetVitals result map.
+// This is normally the DIN, but not all devices have one, so we need to make
+// sure we don't end up with several devices on top of each other.
+func vitalsKey(result map[string]VitalsData, device *VitalsData) string {
+	key := device.Din
+	if key == "" && device.PartNumber != "" && device.SerialNumber != "" {
+		key = device.PartNumber + "--" + device.SerialNumber
+	}
+	if key != "" {
+		if _, exists := result[key]; !exists {
+			return key
+		}
+	} else {
+		key = device.DeviceType
+	}
+	for n := 1; ; n++ {
+		k := fmt.Sprintf("%s#%d", key, n)
+		if _, exists := result[k]; !exists {
+			return k
+		}
+	}
+}
+
+// decodeDeviceWithVitals decodes a DeviceWithVitals message.
+func decodeDeviceWithVitals(data []byte) (*VitalsData, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return nil, err
+	}
+	result := &VitalsData{
+		Vitals: map[string]interface{}{},
+		Alerts: []string{},
+	}
+	for _, f := range fields {
+		if f.wireType != pbWireBytes {
+			continue
+		}
+		switch f.num {
+		case 1:
+			// Device, which just wraps DeviceInfo in field 1
+			devFields, err := pbParse(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, df := range devFields {
+				if df.num == 1 && df.wireType == pbWireBytes {
+					err = decodeDeviceInfo(df.bytes, result)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		case 2:
+			name, value, err := decodeVital(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			result.Vitals[name] = value
+			if result.DeviceType == "" {
+				if i := strings.Index(name, "_"); i > 0 {
+					result.DeviceType = name[:i]
+				}
+			}
+		case 3:
+			result.Alerts = append(result.Alerts, f.String())
+		}
+	}
+	result.decodeTyped()
+	return result, nil
+}
+
+// decodeTyped fills in the typed field corresponding to the device's type
+// (if it's one we know about) from the raw vitals.
+func (v *VitalsData) decodeTyped() {
+	num := func(name string) float64 {
+		value, _ := v.Float(name)
+		return value
+	}
+	str := func(name string) string {
+		value, _ := v.StringValue(name)
+		return value
+	}
+	flag := func(name string) bool {
+		value, _ := v.Bool(name)
+		return value
+	}
+
+	switch v.DeviceType {
+	case "PINV":
+		v.PINV = &PINVVitals{
+			State:               str("PINV_State"),
+			GridState:           str("PINV_GridState"),
+			Fout:                num("PINV_Fout"),
+			Vout:                num("PINV_Vout"),
+			VSplit1:             num("PINV_VSplit1"),
+			VSplit2:             num("PINV_VSplit2"),
+			Pout:                num("PINV_Pout"),
+			PllFrequency:        num("PINV_PllFrequency"),
+			PllLocked:           flag("PINV_PllLocked"),
+			EnergyCharged:       num("PINV_EnergyCharged"),
+			EnergyDischarged:    num("PINV_EnergyDischarged"),
+			ReadyForGridForming: flag("PINV_ReadyForGridForming"),
+			HardwareEnableLine:  flag("PINV_hardwareEnableLine"),
+		}
+	case "POD":
+		v.POD = &PODVitals{
+			NominalEnergyRemaining:  num("POD_nom_energy_remaining"),
+			NominalEnergyToCharge:   num("POD_nom_energy_to_be_charged"),
+			NominalFullPackEnergy:   num("POD_nom_full_pack_energy"),
+			AvailableChargePower:    num("POD_available_charge_power"),
+			AvailableDischargePower: num("POD_available_dischg_power"),
+			ActiveHeating:           flag("POD_ActiveHeating"),
+			ChargeComplete:          flag("POD_ChargeComplete"),
+			ChargeRequest:           flag("POD_ChargeRequest"),
+			DischargeComplete:       flag("POD_DischargeComplete"),
+			PermanentlyFaulted:      flag("POD_PermanentlyFaulted"),
+			PersistentlyFaulted:     flag("POD_PersistentlyFaulted"),
+			EnableLine:              flag("POD_enable_line"),
+			CellVoltages:            map[string]float64{},
+		}
+		for name := range v.Vitals {
+			lower := strings.ToLower(name)
+			if strings.Contains(lower, "cellv") || strings.Contains(lower, "brickv") {
+				if value, ok := v.Float(name); ok {
+					v.POD.CellVoltages[name] = value
+				}
+			}
+		}
+	case "THC":
+		v.THC = &THCVitals{
+			State:       str("THC_State"),
+			AmbientTemp: num("THC_AmbientTemp"),
+		}
+	case "PVAC":
+		v.PVAC = &PVACVitals{
+			State:                 str("PVAC_State"),
+			Fout:                  num("PVAC_Fout"),
+			Vout:                  num("PVAC_Vout"),
+			Pout:                  num("PVAC_Pout"),
+			VL1Ground:             num("PVAC_VL1Ground"),
+			VL2Ground:             num("PVAC_VL2Ground"),
+			LifetimeEnergyPVTotal: num("PVAC_LifetimeEnergyPV_Total"),
+			Strings:               map[string]PVStringVitals{},
+		}
+		for name := range v.Vitals {
+			if !strings.HasPrefix(name, "PVAC_PvState_") {
+				continue
+			}
+			s := strings.TrimPrefix(name, "PVAC_PvState_")
+			v.PVAC.Strings[s] = PVStringVitals{
+				State:   str(name),
+				Current: num("PVAC_PVCurrent_" + s),
+				Voltage: num("PVAC_PVMeasuredVoltage_" + s),
+				Power:   num("PVAC_PVMeasuredPower_" + s),
+			}
+		}
+	case "PVS":
+		v.PVS = &PVSVitals{
+			State:           str("PVS_State"),
+			SelfTestState:   str("PVS_SelfTestState"),
+			VLL:             num("PVS_vLL"),
+			EnableOutput:    flag("PVS_EnableOutput"),
+			StringConnected: map[string]bool{},
+		}
+		for name := range v.Vitals {
+			if strings.HasPrefix(name, "PVS_String") && strings.HasSuffix(name, "_Connected") {
+				s := strings.TrimSuffix(strings.TrimPrefix(name, "PVS_String"), "_Connected")
+				v.PVS.StringConnected[s] = flag(name)
+			}
+		}
+	}
+
+	// The TESYNC reports vitals under several different prefixes
+	// ("ISLAND", "METER", "SYNC", etc), so DeviceType may be any of them.
+	if _, ok := v.Vitals["ISLAND_GridState"]; ok {
+		v.TESYNC = &TESYNCVitals{
+			GridState:     str("ISLAND_GridState"),
+			GridConnected: flag("ISLAND_GridConnected"),
+			FreqL1Main:    num("ISLAND_FreqL1_Main"),
+			FreqL1Load:    num("ISLAND_FreqL1_Load"),
+			VL1NMain:      num("ISLAND_VL1N_Main"),
+			VL1NLoad:      num("ISLAND_VL1N_Load"),
+		}
+	}
+}
+
+// decodeDeviceInfo decodes a DeviceInfo message into the provided VitalsData.
+func decodeDeviceInfo(data []byte, v *VitalsData) error {
+	fields, err := pbParse(data)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.wireType != pbWireBytes {
+			continue
+		}
+		var dest *string
+		switch f.num {
+		case 1:
+			dest = &v.Din
+		case 2:
+			dest = &v.PartNumber
+		case 3:
+			dest = &v.SerialNumber
+		case 4:
+			dest = &v.Manufacturer
+		case 5:
+			dest = &v.SiteLabel
+		case 6:
+			dest = &v.ComponentParentDin
+		case 7:
+			dest = &v.FirmwareVersion
+		case 8:
+			v.FirstCommunicationTime, err = pbTimestamp(f.bytes)
+		case 9:
+			v.LastCommunicationTime, err = pbTimestamp(f.bytes)
+		}
+		if dest != nil {
+			*dest, err = pbWrappedString(f.bytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeVital decodes a Vital message, returning its name and value.
+func decodeVital(data []byte) (string, interface{}, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return "", nil, err
+	}
+	name := ""
+	var value interface{}
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			name = f.String()
+		case 3:
+			value = f.Int()
+		case 4:
+			value = f.Float()
+		case 5:
+			value = f.String()
+		case 6:
+			value = f.Bool()
+		}
+	}
+	return name, value, nil
+}
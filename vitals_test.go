@@ -0,0 +1,117 @@
+package powerwall
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testVital is a single vital to encode in a test DeviceWithVitals message.
+type testVital struct {
+	name  string
+	value interface{}
+}
+
+func encodeTestDevice(w *pbWriter, din string, partNumber string, serial string, vitals []testVital) {
+	w.Message(1, func(w *pbWriter) {
+		w.Message(1, func(w *pbWriter) {
+			w.Message(1, func(w *pbWriter) {
+				if din != "" {
+					w.Message(1, func(w *pbWriter) { w.String(1, din) })
+				}
+				if partNumber != "" {
+					w.Message(2, func(w *pbWriter) { w.String(1, partNumber) })
+				}
+				if serial != "" {
+					w.Message(3, func(w *pbWriter) { w.String(1, serial) })
+				}
+			})
+		})
+		for _, v := range vitals {
+			w.Message(2, func(w *pbWriter) {
+				w.String(1, v.name)
+				switch x := v.value.(type) {
+				case int:
+					w.Varint(3, uint64(x))
+				case float64:
+					var buf [8]byte
+					binary.LittleEndian.PutUint64(buf[:], math.Float64bits(x))
+					w.key(4, pbWireFixed64)
+					w.buf = append(w.buf, buf[:]...)
+				case string:
+					w.String(5, x)
+				case bool:
+					w.Bool(6, x)
+				}
+			})
+		}
+		w.String(3, "SomeAlert")
+	})
+}
+
+func TestDecodeVitalsTyped(t *testing.T) {
+	w := &pbWriter{}
+	encodeTestDevice(w, "1232100-00-E--TG000000000001", "", "", []testVital{
+		{"PINV_Fout", 60.01},
+		{"PINV_Vout", 241.5},
+		{"PINV_State", "PINV_GridFollowing"},
+		{"PINV_PllLocked", true},
+	})
+	encodeTestDevice(w, "", "1081100-10-Y", "TG000000000002", []testVital{
+		{"THC_AmbientTemp", 23.5},
+		{"THC_State", "THC_STATE_AUTONOMOUSCONTROL"},
+	})
+	encodeTestDevice(w, "", "", "", []testVital{
+		{"POD_nom_energy_remaining", 10125},
+		{"POD_CellVoltage_1", 3.45},
+	})
+	encodeTestDevice(w, "", "", "", []testVital{
+		{"POD_nom_energy_remaining", 9000},
+	})
+	encodeTestDevice(w, "", "", "", []testVital{
+		{"PVAC_State", "PVAC_Active"},
+		{"PVAC_PvState_A", "PV_Active"},
+		{"PVAC_PVMeasuredPower_A", 1500.0},
+		{"PVAC_PVMeasuredVoltage_A", 350.0},
+	})
+
+	result, err := decodeVitals(w.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 5 {
+		t.Fatalf("expected 5 devices, got %d: %v", len(result), result)
+	}
+
+	pinv := result["1232100-00-E--TG000000000001"]
+	if pinv.PINV == nil || pinv.PINV.Fout != 60.01 || pinv.PINV.Vout != 241.5 || pinv.PINV.State != "PINV_GridFollowing" || !pinv.PINV.PllLocked {
+		t.Errorf("bad PINV vitals: %+v", pinv.PINV)
+	}
+	if pinv.POD != nil || pinv.THC != nil {
+		t.Errorf("unexpected typed vitals for PINV device: %+v", pinv)
+	}
+	if len(pinv.Alerts) != 1 || pinv.Alerts[0] != "SomeAlert" {
+		t.Errorf("bad alerts: %v", pinv.Alerts)
+	}
+
+	thc := result["1081100-10-Y--TG000000000002"]
+	if thc.THC == nil || thc.THC.AmbientTemp != 23.5 {
+		t.Errorf("bad THC vitals: %+v", thc.THC)
+	}
+
+	pod1, pod2 := result["POD#1"], result["POD#2"]
+	if pod1.POD == nil || pod2.POD == nil {
+		t.Fatalf("devices without DIN were not kept separately: %v", result)
+	}
+	if pod1.POD.NominalEnergyRemaining != 10125 || pod1.POD.CellVoltages["POD_CellVoltage_1"] != 3.45 {
+		t.Errorf("bad POD vitals: %+v", pod1.POD)
+	}
+	if pod2.POD.NominalEnergyRemaining != 9000 {
+		t.Errorf("bad POD vitals: %+v", pod2.POD)
+	}
+
+	pvac := result["PVAC#1"]
+	if pvac.PVAC == nil || pvac.PVAC.Strings["A"].Power != 1500 || pvac.PVAC.Strings["A"].State != "PV_Active" {
+		t.Errorf("bad PVAC vitals: %+v", pvac.PVAC)
+	}
+}
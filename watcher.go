@@ -0,0 +1,354 @@
+// Functions for continuously monitoring the gateway:
+//
+//   NewWatcher(client, intervals)
+//   (*Watcher) Start(ctx)
+//   (*Watcher) Stop()
+//   (*Watcher) Snapshots()
+//   (*Watcher) Latest()
+//   (*Watcher) Refresh(ctx, endpoint)
+//
+package powerwall
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WatchEndpoint identifies one of the API calls which a Watcher can poll.
+// (The values are the same as the corresponding API endpoint names.)
+type WatchEndpoint string
+
+// Endpoints which can be polled by a Watcher:
+const (
+	WatchMetersAggregates WatchEndpoint = "meters/aggregates"
+	WatchSOE              WatchEndpoint = "system_status/soe"
+	WatchGridStatus       WatchEndpoint = "system_status/grid_status"
+	WatchGridFaults       WatchEndpoint = "system_status/grid_faults"
+	WatchSystemStatus     WatchEndpoint = "system_status"
+	WatchOperation        WatchEndpoint = "operation"
+	WatchSitemaster       WatchEndpoint = "sitemaster"
+)
+
+// DefaultWatchIntervals is the set of endpoints (and how often to poll them)
+// which will be used by NewWatcher if nil is passed for the intervals.
+var DefaultWatchIntervals = map[WatchEndpoint]time.Duration{
+	WatchMetersAggregates: 10 * time.Second,
+	WatchSOE:              30 * time.Second,
+	WatchGridStatus:       10 * time.Second,
+}
+
+// Snapshot contains the most recent successfully-fetched value for each of
+// the endpoints a Watcher is polling.  Fields for endpoints which are not
+// being polled (or have never been successfully fetched) will be nil.
+//
+// Because the gateway is not always reachable (it tends to drop off the
+// network occasionally), a Snapshot may contain values which are out of date.
+// The Updated field records when each endpoint was last successfully fetched,
+// and Errors contains the error from the most recent attempt for any
+// endpoints whose last fetch failed.  The Age and Stale functions can be used
+// to check whether a given value is still current enough to be useful.
+type Snapshot struct {
+	// Time is when this snapshot was produced.
+	Time time.Time
+	// Endpoint is the endpoint whose fetch (successful or not) caused this
+	// snapshot to be produced.
+	Endpoint WatchEndpoint
+
+	MetersAggregates *map[string]MeterAggregatesData
+	SOE              *SOEData
+	GridStatus       *GridStatusData
+	GridFaults       *[]GridFaultData
+	SystemStatus     *SystemStatusData
+	Operation        *OperationData
+	Sitemaster       *SitemasterData
+
+	Updated map[WatchEndpoint]time.Time
+	Errors  map[WatchEndpoint]error
+}
+
+// Age returns how long ago the value for the specified endpoint was last
+// successfully fetched (as of when the snapshot was produced).  If it has
+// never been fetched, ok will be false.
+func (s *Snapshot) Age(endpoint WatchEndpoint) (age time.Duration, ok bool) {
+	t, ok := s.Updated[endpoint]
+	if !ok {
+		return 0, false
+	}
+	return s.Time.Sub(t), true
+}
+
+// Stale returns true if the value for the specified endpoint is older than
+// maxAge (or has never been fetched).
+func (s *Snapshot) Stale(endpoint WatchEndpoint, maxAge time.Duration) bool {
+	age, ok := s.Age(endpoint)
+	return !ok || age > maxAge
+}
+
+// copy returns a copy of the snapshot which does not share its maps.
+func (s *Snapshot) copy() Snapshot {
+	result := *s
+	result.Updated = make(map[WatchEndpoint]time.Time, len(s.Updated))
+	for k, v := range s.Updated {
+		result.Updated[k] = v
+	}
+	result.Errors = make(map[WatchEndpoint]error, len(s.Errors))
+	for k, v := range s.Errors {
+		result.Errors[k] = v
+	}
+	return result
+}
+
+// Watcher polls a Client periodically, and produces Snapshot values
+// containing the latest data.  Each endpoint is polled at its own interval.
+//
+// If more than one fetch of the same endpoint is requested at the same time
+// (for example, a call to Refresh while a scheduled poll is in progress), only
+// one request will actually be made to the gateway, and all of the callers
+// will share the result.
+type Watcher struct {
+	client    *Client
+	intervals map[WatchEndpoint]time.Duration
+	snap_ch   chan Snapshot
+	mutex     sync.Mutex
+	current   Snapshot
+	inflight  map[WatchEndpoint]*watchCall
+	stopped   bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+type watchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewWatcher creates a new Watcher for the provided client.  intervals
+// specifies which endpoints to poll, and how often to poll each one.  If
+// intervals is nil, DefaultWatchIntervals is used.  Endpoints with an interval
+// of zero (or less) are not polled (but can still be fetched with Refresh).
+//
+// The watcher does not start polling until Start is called.
+func NewWatcher(c *Client, intervals map[WatchEndpoint]time.Duration) *Watcher {
+	if intervals == nil {
+		intervals = DefaultWatchIntervals
+	}
+	w := &Watcher{
+		client:    c,
+		intervals: make(map[WatchEndpoint]time.Duration, len(intervals)),
+		// This is buffered by one, and we always replace any unread
+		// snapshot with the newest one, so a slow reader will never
+		// hold up polling (it will just skip some snapshots).
+		snap_ch:  make(chan Snapshot, 1),
+		inflight: map[WatchEndpoint]*watchCall{},
+		current: Snapshot{
+			Updated: map[WatchEndpoint]time.Time{},
+			Errors:  map[WatchEndpoint]error{},
+		},
+	}
+	for endpoint, interval := range intervals {
+		if interval <= 0 {
+			c.logf("Watcher: not polling %s (invalid interval %s)", endpoint, interval)
+			continue
+		}
+		w.intervals[endpoint] = interval
+	}
+	// Fetches are shared between callers, so they can't use any one
+	// caller's context.  Instead, they use this one, which lasts for the
+	// lifetime of the watcher.
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+// Start begins polling in the background.  Polling continues until Stop is
+// called or the provided context is cancelled (either of which also cancels
+// any fetches still in progress).
+func (w *Watcher) Start(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.stop()
+		case <-w.ctx.Done():
+		}
+	}()
+	for endpoint, interval := range w.intervals {
+		w.wg.Add(1)
+		go w.pollLoop(endpoint, interval)
+	}
+	go func() {
+		<-w.ctx.Done()
+		w.wg.Wait()
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.stopped = true
+		close(w.snap_ch)
+	}()
+}
+
+// Stop stops polling, and waits for any fetches in progress to finish.  The
+// channel returned by Snapshots will be closed.
+func (w *Watcher) Stop() {
+	w.stop()
+	w.wg.Wait()
+}
+
+// stop cancels the watcher's context.  This is done with the mutex held, so
+// that once it's done, fetch will not start any new fetches (which would
+// otherwise race with waiting for the existing ones to finish).
+func (w *Watcher) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.cancel()
+}
+
+// Snapshots returns a channel which will receive a new Snapshot every time an
+// endpoint is polled (whether or not it was successful).  If the reader does
+// not keep up, intermediate snapshots are discarded, so the next one received
+// will always be the most recent.  The channel is closed when the watcher is
+// stopped.
+func (w *Watcher) Snapshots() <-chan Snapshot {
+	return w.snap_ch
+}
+
+// Latest returns the current snapshot (as of now).
+func (w *Watcher) Latest() Snapshot {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	s := w.current.copy()
+	s.Time = time.Now()
+	return s
+}
+
+// Refresh immediately fetches the specified endpoint (or waits for an
+// in-progress fetch of it to complete), and returns the resulting snapshot.
+// The endpoint does not need to be one of the ones being polled.
+//
+// If ctx is cancelled, Refresh returns straight away, but the fetch itself
+// carries on (for the benefit of anyone else waiting for it).
+func (w *Watcher) Refresh(ctx context.Context, endpoint WatchEndpoint) (Snapshot, error) {
+	err := w.fetch(ctx, endpoint)
+	return w.Latest(), err
+}
+
+func (w *Watcher) pollLoop(endpoint WatchEndpoint, interval time.Duration) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.fetch(w.ctx, endpoint)
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch fetches the endpoint, coalescing concurrent requests for the same
+// endpoint into a single call.  The call itself is made using the watcher's
+// context, and ctx only limits how long this caller waits for it.
+func (w *Watcher) fetch(ctx context.Context, endpoint WatchEndpoint) error {
+	w.mutex.Lock()
+	if err := w.ctx.Err(); err != nil {
+		// The watcher has been stopped.
+		w.mutex.Unlock()
+		return err
+	}
+	call, ok := w.inflight[endpoint]
+	if !ok {
+		call = &watchCall{done: make(chan struct{})}
+		w.inflight[endpoint] = call
+		w.wg.Add(1)
+		go w.doFetch(w.ctx, endpoint, call)
+	}
+	w.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Watcher) doFetch(ctx context.Context, endpoint WatchEndpoint, call *watchCall) {
+	defer w.wg.Done()
+	var value interface{}
+	var err error
+	c := w.client
+
+	switch endpoint {
+	case WatchMetersAggregates:
+		value, err = c.GetMetersAggregatesContext(ctx)
+	case WatchSOE:
+		value, err = c.GetSOEContext(ctx)
+	case WatchGridStatus:
+		value, err = c.GetGridStatusContext(ctx)
+	case WatchGridFaults:
+		value, err = c.GetGridFaultsContext(ctx)
+	case WatchSystemStatus:
+		value, err = c.GetSystemStatusContext(ctx)
+	case WatchOperation:
+		value, err = c.GetOperationContext(ctx)
+	case WatchSitemaster:
+		value, err = c.GetSitemasterContext(ctx)
+	default:
+		err = fmt.Errorf("unknown watch endpoint %q", endpoint)
+	}
+
+	w.mutex.Lock()
+	now := time.Now()
+	if err != nil {
+		w.current.Errors[endpoint] = err
+		c.logf("Watcher: error fetching %s: %s", endpoint, err)
+	} else {
+		delete(w.current.Errors, endpoint)
+		w.current.Updated[endpoint] = now
+		switch v := value.(type) {
+		case *map[string]MeterAggregatesData:
+			w.current.MetersAggregates = v
+		case *SOEData:
+			w.current.SOE = v
+		case *GridStatusData:
+			w.current.GridStatus = v
+		case *[]GridFaultData:
+			w.current.GridFaults = v
+		case *SystemStatusData:
+			w.current.SystemStatus = v
+		case *OperationData:
+			w.current.Operation = v
+		case *SitemasterData:
+			w.current.Sitemaster = v
+		}
+	}
+	snap := w.current.copy()
+	snap.Time = now
+	snap.Endpoint = endpoint
+	delete(w.inflight, endpoint)
+	w.send(snap)
+	w.mutex.Unlock()
+
+	call.err = err
+	close(call.done)
+}
+
+// send delivers a snapshot to the channel, replacing any unread one.  (This
+// must be called with the mutex held.)
+func (w *Watcher) send(snap Snapshot) {
+	if w.stopped {
+		return
+	}
+	for {
+		select {
+		case w.snap_ch <- snap:
+			return
+		default:
+		}
+		select {
+		case <-w.snap_ch:
+		default:
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package powerwall_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foogod/go-powerwall"
+	"github.com/foogod/go-powerwall/powerwalltest"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+
+	// Invalid intervals should just be skipped (not panic).
+	w := powerwall.NewWatcher(client, map[powerwall.WatchEndpoint]time.Duration{
+		powerwall.WatchSOE:        50 * time.Millisecond,
+		powerwall.WatchGridStatus: 0,
+		powerwall.WatchOperation:  -time.Second,
+	})
+	w.Start(context.Background())
+	timeout := time.After(5 * time.Second)
+	for count := 0; count < 3; {
+		select {
+		case snap := <-w.Snapshots():
+			if snap.Endpoint != powerwall.WatchSOE {
+				t.Errorf("unexpected endpoint polled: %s", snap.Endpoint)
+			}
+			if snap.SOE == nil {
+				t.Errorf("no SOE in snapshot: %+v", snap)
+			}
+			count++
+		case <-timeout:
+			t.Fatal("timed out waiting for snapshots")
+		}
+	}
+	w.Stop()
+	for range w.Snapshots() {
+	}
+	if _, err := w.Refresh(context.Background(), powerwall.WatchSOE); err == nil {
+		t.Errorf("Refresh after Stop did not return an error")
+	}
+}
+
+func TestWatcherSharedFetch(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+	// Log in first, so the only request we're timing is the fetch.
+	if err := client.DoLogin(); err != nil {
+		t.Fatal(err)
+	}
+	s.ResetRequests()
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 500 * time.Millisecond})
+
+	w := powerwall.NewWatcher(client, map[powerwall.WatchEndpoint]time.Duration{})
+	defer w.Stop()
+
+	// The first caller gives up part way through, but that should not
+	// affect the second one, which is sharing the same fetch.
+	var wg sync.WaitGroup
+	var cancelledErr, sharedErr error
+	var snap powerwall.Snapshot
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, cancelledErr = w.Refresh(ctx, powerwall.WatchSOE)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		snap, sharedErr = w.Refresh(context.Background(), powerwall.WatchSOE)
+	}()
+	wg.Wait()
+
+	if !errors.Is(cancelledErr, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded for the first caller, got %v", cancelledErr)
+	}
+	if sharedErr != nil {
+		t.Errorf("shared fetch failed: %v", sharedErr)
+	} else if snap.SOE == nil {
+		t.Errorf("no SOE in snapshot: %+v", snap)
+	}
+	count := 0
+	for _, r := range s.Requests() {
+		if r.API == "system_status/soe" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 1 request, got %d", count)
+	}
+}
+
+func TestWatcherStopWaitsForFetch(t *testing.T) {
+	s := powerwalltest.NewServer()
+	defer s.Close()
+	client := s.NewClient(powerwall.WithLogger(t.Log))
+	defer client.Close()
+	s.SetFault("system_status/soe", powerwalltest.Fault{Latency: 5 * time.Second})
+
+	w := powerwall.NewWatcher(client, map[powerwall.WatchEndpoint]time.Duration{})
+	w.Start(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w.Refresh(ctx, powerwall.WatchSOE)
+
+	start := time.Now()
+	w.Stop()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch was not cancelled by Stop (took %s)", elapsed)
+	}
+	// The fetch must have finished (and recorded its result) by the time
+	// Stop returns.
+	if snap := w.Latest(); snap.Errors[powerwall.WatchSOE] == nil {
+		t.Errorf("Stop returned before the fetch in progress finished")
+	}
+}